@@ -0,0 +1,290 @@
+package gobot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"euphoria.io/heim/proto/snowflake"
+)
+
+// AdminConfig enables the admin HTTP API, which lets operators inspect and
+// control a running bot; see Bot.AdminHandler. Addr is the address to listen
+// on, such as "localhost:8081", and Token is the secret that requests must
+// present as "Authorization: Bearer <Token>". The API is disabled if Addr is
+// empty, and a Token is required if it is not.
+type AdminConfig struct {
+	Addr  string `yaml:"Addr,omitempty"`
+	Token string `yaml:"Token,omitempty"`
+}
+
+// RoomState describes a room's connection to the server.
+type RoomState string
+
+const (
+	// RoomIdle is the state of a room that has been added but not run yet.
+	RoomIdle RoomState = "idle"
+
+	// RoomConnecting is the state of a room that has not connected yet or is
+	// reconnecting after losing its connection.
+	RoomConnecting RoomState = "connecting"
+
+	// RoomConnected is the state of a running room with a connection.
+	RoomConnected RoomState = "connected"
+
+	// RoomRestarting is the state of a room that has failed and is waiting to
+	// be restarted by its supervisor; see RestartPolicy.
+	RoomRestarting RoomState = "restarting"
+
+	// RoomStopped is the state of a room that has been stopped or has failed
+	// for good.
+	RoomStopped RoomState = "stopped"
+)
+
+var roomStates = []RoomState{RoomIdle, RoomConnecting, RoomConnected, RoomRestarting, RoomStopped}
+
+// State returns the room's connection state.
+func (r *Room) State() RoomState {
+	return roomStates[atomic.LoadInt32(&r.state)]
+}
+
+// setState records the room's connection state. A room whose context is
+// finished stays stopped, even if its connection is still trying to reconnect.
+func (r *Room) setState(state RoomState) {
+	if state != RoomStopped && !r.Ctx.Alive() {
+		return
+	}
+	r.storeState(state)
+}
+
+func (r *Room) storeState(state RoomState) {
+	for i, s := range roomStates {
+		if s == state {
+			atomic.StoreInt32(&r.state, int32(i))
+		}
+	}
+}
+
+// RoomStatus is a snapshot of a room, as reported by the admin API.
+type RoomStatus struct {
+	Name     string
+	State    RoomState
+	Paused   bool
+	Handlers []HandlerStatus
+}
+
+// Status returns a snapshot of the room's state and its handlers' status.
+func (r *Room) Status() RoomStatus {
+	return RoomStatus{
+		Name:     r.RoomName,
+		State:    r.State(),
+		Paused:   r.Paused(),
+		Handlers: r.HandlerStatus(),
+	}
+}
+
+// AdminSend is the body of a request to send a message through the admin API.
+// Parent is the ID of the message to reply to, if any.
+type AdminSend struct {
+	Text   string
+	Parent snowflake.Snowflake
+}
+
+// AdminHandler returns an http.Handler serving the admin API, which accepts
+// only requests bearing the given token. It serves JSON at:
+//
+//	GET  /rooms                  the RoomStatus of each room
+//	GET  /rooms/<name>           the RoomStatus of the named room
+//	GET  /rooms/<name>/handlers  the HandlerStatus of the room's handlers
+//	POST /rooms/<name>/start     restart a stopped room, see RestartRoom
+//	POST /rooms/<name>/stop      stop a room, see Room.Stop
+//	POST /rooms/<name>/send      send an AdminSend as the bot; replies with
+//	                             the server's send-reply
+//
+// Starting a room requires RunAllRooms to be running; until it is, start fails
+// with 503 Service Unavailable. A room counts as running, for start and stop,
+// as long as its supervisor has not given up on it.
+func (b *Bot) AdminHandler(token string) http.Handler {
+	return &adminHandler{bot: b, token: token}
+}
+
+type adminHandler struct {
+	bot   *Bot
+	token string
+}
+
+type adminError struct {
+	Error string
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		h.fail(w, http.StatusUnauthorized, "Invalid or missing token")
+		return
+	}
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "rooms" || len(parts) > 3 {
+		h.fail(w, http.StatusNotFound, fmt.Sprintf("No such endpoint: %s", req.URL.Path))
+		return
+	}
+	if len(parts) == 1 {
+		if h.method(w, req, "GET") {
+			h.listRooms(w)
+		}
+		return
+	}
+	room, ok := h.bot.Room(parts[1])
+	if !ok {
+		h.fail(w, http.StatusNotFound, fmt.Sprintf("No such room: %s", parts[1]))
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+	switch action {
+	case "":
+		if h.method(w, req, "GET") {
+			h.reply(w, room.Status())
+		}
+	case "handlers":
+		if h.method(w, req, "GET") {
+			h.reply(w, room.HandlerStatus())
+		}
+	case "start":
+		if h.method(w, req, "POST") {
+			h.startRoom(w, room)
+		}
+	case "stop":
+		if h.method(w, req, "POST") {
+			h.stopRoom(w, room)
+		}
+	case "send":
+		if h.method(w, req, "POST") {
+			h.send(w, req, room)
+		}
+	default:
+		h.fail(w, http.StatusNotFound, fmt.Sprintf("No such endpoint: %s", req.URL.Path))
+	}
+}
+
+func (h *adminHandler) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if h.token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(h.token)) == 1
+}
+
+// method checks the request's method and reports whether it is the expected
+// one, failing the request if not.
+func (h *adminHandler) method(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	h.fail(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", req.Method))
+	return false
+}
+
+func (h *adminHandler) listRooms(w http.ResponseWriter) {
+	names := h.bot.roomNames()
+	status := make([]RoomStatus, 0, len(names))
+	for _, name := range names {
+		if room, ok := h.bot.Room(name); ok {
+			status = append(status, room.Status())
+		}
+	}
+	h.reply(w, status)
+}
+
+func (h *adminHandler) startRoom(w http.ResponseWriter, room *Room) {
+	if !h.bot.serving() {
+		h.fail(w, http.StatusServiceUnavailable, "Bot is not running its rooms")
+		return
+	}
+	if h.bot.supervised(room.RoomName) {
+		h.fail(w, http.StatusConflict, fmt.Sprintf("Room %s is already running", room.RoomName))
+		return
+	}
+	h.bot.Logger.Infof("Starting room %s through the admin API", room.RoomName)
+	if err := h.bot.RestartRoom(room.RoomName); err != nil {
+		h.fail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	room, _ = h.bot.Room(room.RoomName)
+	h.reply(w, room.Status())
+}
+
+func (h *adminHandler) stopRoom(w http.ResponseWriter, room *Room) {
+	if !h.bot.supervised(room.RoomName) {
+		h.fail(w, http.StatusConflict, fmt.Sprintf("Room %s is not running", room.RoomName))
+		return
+	}
+	h.bot.Logger.Infof("Stopping room %s through the admin API", room.RoomName)
+	if err := h.bot.haltRoom(room.RoomName); err != nil {
+		h.fail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	room, _ = h.bot.Room(room.RoomName)
+	h.reply(w, room.Status())
+}
+
+func (h *adminHandler) send(w http.ResponseWriter, req *http.Request, room *Room) {
+	var msg AdminSend
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		h.fail(w, http.StatusBadRequest, fmt.Sprintf("Invalid message: %s", err))
+		return
+	}
+	if msg.Text == "" {
+		h.fail(w, http.StatusBadRequest, "Invalid message: no text")
+		return
+	}
+	if room.State() != RoomConnected {
+		h.fail(w, http.StatusConflict, fmt.Sprintf("Room %s is not connected", room.RoomName))
+		return
+	}
+	var parent *snowflake.Snowflake
+	if msg.Parent != 0 {
+		parent = &msg.Parent
+	}
+	h.bot.Logger.Infof("Sending message to room %s through the admin API", room.RoomName)
+	reply, err := room.SendTextSync(parent, msg.Text, DefaultCallTimeout)
+	if err != nil {
+		h.fail(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	h.reply(w, reply)
+}
+
+func (h *adminHandler) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.bot.Logger.Warningf("Error writing admin reply: %s", err)
+	}
+}
+
+func (h *adminHandler) fail(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(adminError{Error: msg}); err != nil {
+		h.bot.Logger.Warningf("Error writing admin reply: %s", err)
+	}
+}
+
+// serveAdmin starts the admin API described by cfg, if it is enabled.
+func (b *Bot) serveAdmin(cfg AdminConfig) error {
+	if cfg.Addr == "" {
+		return nil
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("Admin API on %s needs a token", cfg.Addr)
+	}
+	return b.serveHTTP("admin API", cfg.Addr, b.AdminHandler(cfg.Token))
+}
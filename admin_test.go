@@ -0,0 +1,178 @@
+package gobot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+type AdminSuite struct {
+	bot  *Bot
+	conn *MockConn
+	srv  *httptest.Server
+}
+
+var _ = Suite(&AdminSuite{})
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	room, _ := b.Room("test")
+	room.Handlers = []Handler{&replyHandler{}}
+	s.bot, s.conn = b, conn
+	s.srv = httptest.NewServer(b.AdminHandler("secret"))
+	go b.RunAllRooms()
+	waitFor(c, func() bool {
+		room, _ := b.Room("test")
+		return room.State() == RoomConnected
+	})
+}
+
+func (s *AdminSuite) TearDownTest(c *C) {
+	s.srv.Close()
+	s.bot.Stop()
+}
+
+// do makes a request to the admin API and decodes the reply into v.
+func (s *AdminSuite) do(c *C, method, path, token, body string, v interface{}) int {
+	req, err := http.NewRequest(method, s.srv.URL+path, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.srv.Client().Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	if v != nil {
+		c.Check(json.NewDecoder(resp.Body).Decode(v), IsNil)
+	}
+	return resp.StatusCode
+}
+
+func (s *AdminSuite) TestAuth(c *C) {
+	var e adminError
+	c.Check(s.do(c, "GET", "/rooms", "", "", &e), Equals, http.StatusUnauthorized)
+	c.Check(e.Error, Equals, "Invalid or missing token")
+	c.Check(s.do(c, "GET", "/rooms", "wrong", "", nil), Equals, http.StatusUnauthorized)
+	c.Check(s.do(c, "GET", "/rooms", "secret", "", nil), Equals, http.StatusOK)
+
+	open := httptest.NewServer(s.bot.AdminHandler(""))
+	defer open.Close()
+	resp, err := open.Client().Get(open.URL + "/rooms")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (s *AdminSuite) TestStatus(c *C) {
+	var rooms []RoomStatus
+	c.Check(s.do(c, "GET", "/rooms", "secret", "", &rooms), Equals, http.StatusOK)
+	c.Assert(rooms, HasLen, 1)
+	c.Check(rooms[0].Name, Equals, "test")
+	c.Check(rooms[0].State, Equals, RoomConnected)
+	c.Check(rooms[0].Paused, Equals, false)
+
+	var handlers []HandlerStatus
+	c.Check(s.do(c, "GET", "/rooms/test/handlers", "secret", "", &handlers), Equals, http.StatusOK)
+	c.Assert(handlers, HasLen, 1)
+	c.Check(handlers[0].Name, Equals, "*gobot.replyHandler")
+
+	var e adminError
+	c.Check(s.do(c, "GET", "/rooms/nowhere", "secret", "", &e), Equals, http.StatusNotFound)
+	c.Check(e.Error, Equals, "No such room: nowhere")
+	c.Check(s.do(c, "POST", "/rooms/test", "secret", "", nil), Equals, http.StatusMethodNotAllowed)
+	c.Check(s.do(c, "GET", "/rooms/test/bogus", "secret", "", nil), Equals, http.StatusNotFound)
+}
+
+func (s *AdminSuite) TestStopStart(c *C) {
+	var status RoomStatus
+	c.Check(s.do(c, "POST", "/rooms/test/stop", "secret", "", &status), Equals, http.StatusOK)
+	c.Check(status.State, Equals, RoomStopped)
+	c.Check(s.do(c, "POST", "/rooms/test/stop", "secret", "", nil), Equals, http.StatusConflict)
+
+	c.Check(s.do(c, "POST", "/rooms/test/start", "secret", "", nil), Equals, http.StatusOK)
+	waitFor(c, func() bool {
+		room, _ := s.bot.Room("test")
+		return room.State() == RoomConnected
+	})
+	c.Check(s.do(c, "POST", "/rooms/test/start", "secret", "", nil), Equals, http.StatusConflict)
+}
+
+// replace stops the running bot and serves the admin API of the one made by
+// newBot instead, which is not running.
+func (s *AdminSuite) replace(c *C, newBot func() (*Bot, *MockConn, error)) *Bot {
+	s.srv.Close()
+	s.bot.Stop()
+	b, conn, err := newBot()
+	c.Assert(err, IsNil)
+	s.bot, s.conn = b, conn
+	s.srv = httptest.NewServer(b.AdminHandler("secret"))
+	return b
+}
+
+func (s *AdminSuite) TestNotRunning(c *C) {
+	s.replace(c, BasicMockBot)
+	var status RoomStatus
+	c.Check(s.do(c, "GET", "/rooms/test", "secret", "", &status), Equals, http.StatusOK)
+	c.Check(status.State, Equals, RoomIdle)
+	var e adminError
+	c.Check(s.do(c, "POST", "/rooms/test/start", "secret", "", &e), Equals, http.StatusServiceUnavailable)
+	c.Check(e.Error, Equals, "Bot is not running its rooms")
+	c.Check(s.do(c, "POST", "/rooms/test/stop", "secret", "", nil), Equals, http.StatusConflict)
+}
+
+func (s *AdminSuite) TestStopDuringBackoff(c *C) {
+	b := s.replace(c, func() (*Bot, *MockConn, error) {
+		return MockBotWithRestart(RestartAlways)
+	})
+	room, _ := b.Room("test")
+	room.cfg.RestartBackoff = time.Hour
+	go b.RunAllRooms()
+	waitFor(c, func() bool { return room.State() == RoomConnected })
+	s.conn.incoming <- disconnectPacket()
+	waitFor(c, func() bool { return room.State() == RoomRestarting })
+
+	var status RoomStatus
+	c.Check(s.do(c, "GET", "/rooms/test", "secret", "", &status), Equals, http.StatusOK)
+	c.Check(status.State, Equals, RoomRestarting)
+	c.Check(s.do(c, "POST", "/rooms/test/start", "secret", "", nil), Equals, http.StatusConflict)
+	c.Check(s.do(c, "POST", "/rooms/test/stop", "secret", "", &status), Equals, http.StatusOK)
+	c.Check(status.State, Equals, RoomStopped)
+
+	c.Check(s.do(c, "POST", "/rooms/test/start", "secret", "", nil), Equals, http.StatusOK)
+	waitFor(c, func() bool {
+		room, _ := b.Room("test")
+		return room.State() == RoomConnected
+	})
+}
+
+func (s *AdminSuite) TestSend(c *C) {
+	// The admin API sends even while the room is paused.
+	room, _ := s.bot.Room("test")
+	room.Pause()
+	go func() {
+		select {
+		case p := <-s.conn.outgoing:
+			payload, _ := p.Payload()
+			cmd := payload.(*proto.SendCommand)
+			reply, _ := MakePacket(proto.SendReplyType, proto.SendReply{ID: 42, Parent: cmd.Parent, Content: cmd.Content})
+			reply.ID = p.ID
+			s.conn.incoming <- reply
+		case <-time.After(time.Second):
+		}
+	}()
+	var reply proto.SendReply
+	c.Check(s.do(c, "POST", "/rooms/test/send", "secret", `{"Text": "hello", "Parent": "ya"}`, &reply), Equals, http.StatusOK)
+	c.Check(int(reply.ID), Equals, 42)
+	c.Check(reply.Content, Equals, "hello")
+	c.Check(int(reply.Parent), Equals, 1234)
+
+	var e adminError
+	c.Check(s.do(c, "POST", "/rooms/test/send", "secret", `{}`, &e), Equals, http.StatusBadRequest)
+	c.Check(e.Error, Equals, "Invalid message: no text")
+}
@@ -0,0 +1,432 @@
+package gobot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/boltdb/bolt"
+)
+
+// archiveBucket is the reserved bucket holding the archive of each room.
+const archiveBucket = "_gobot_archive"
+
+// archiveQueueSize is the number of packets that may wait to be written to a
+// room's archive. Packets received while the queue is full are not archived.
+const archiveQueueSize = 1024
+
+// Buckets kept for each archived room.
+var (
+	archiveMessages = []byte("messages") // message ID -> proto.Message
+	archiveTimes    = []byte("time")     // time, message ID -> nothing
+	archiveSenders  = []byte("sender")   // normalized nick, 0, message ID -> nothing
+	archiveReplies  = []byte("replies")  // parent ID, message ID -> nothing
+	archivePresence = []byte("presence") // time, sequence -> ArchivedPresence
+)
+
+// ArchivedPresence records a session joining or leaving an archived room.
+type ArchivedPresence struct {
+	Time    time.Time         `json:"time"`
+	Type    proto.PacketType  `json:"type"`
+	Session proto.SessionView `json:"session"`
+}
+
+// ArchiveQuery selects messages from an Archive. Zero fields match every
+// message.
+//
+// Since and Until bound the time the messages were sent; Since is inclusive
+// and Until exclusive. Sender matches the nick the messages were sent under,
+// ignoring case and spaces. Thread matches a message and all of its replies,
+// recursively. If Limit is positive, only the most recent Limit matching
+// messages are returned.
+type ArchiveQuery struct {
+	Since  time.Time
+	Until  time.Time
+	Sender string
+	Thread snowflake.Snowflake
+	Limit  int
+}
+
+// Archive is the stored history of a room. Rooms whose RoomConfig sets Archive
+// record every message, edit, join and part in the bot's database as they are
+// received, in a reserved bucket that does not collide with handler data. The
+// records are written in the background, so a message may take a moment to
+// appear in the archive. Messages keep their latest edit; deleted messages are
+// kept with Deleted set.
+type Archive struct {
+	db    *bolt.DB
+	room  string
+	index bool // whether written messages are indexed for Search
+}
+
+// Archive returns the archive of the named room. It is empty unless the room
+// is configured to be archived.
+func (b *Bot) Archive(roomName string) *Archive {
+	return &Archive{db: b.DB, room: roomName}
+}
+
+// Archive returns the room's archive; see Bot.Archive.
+func (r *Room) Archive() *Archive {
+	return &Archive{db: r.DB, room: r.RoomName}
+}
+
+// Message returns the archived message with the given ID and whether it was
+// found.
+func (a *Archive) Message(id snowflake.Snowflake) (proto.Message, bool, error) {
+	var msg proto.Message
+	var ok bool
+	err := a.view(func(b *bolt.Bucket) error {
+		data := b.Bucket(archiveMessages).Get(idKey(id))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &msg)
+	})
+	return msg, ok, err
+}
+
+// Messages returns the archived messages matching q, oldest first.
+func (a *Archive) Messages(q ArchiveQuery) ([]proto.Message, error) {
+	var msgs []proto.Message
+	err := a.view(func(b *bolt.Bucket) error {
+		ids := a.candidates(b, q)
+		messages := b.Bucket(archiveMessages)
+		for _, id := range ids {
+			data := messages.Get(idKey(id))
+			if data == nil {
+				continue
+			}
+			var msg proto.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return err
+			}
+			if q.matches(&msg) {
+				msgs = append(msgs, msg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byID(msgs))
+	if q.Limit > 0 && len(msgs) > q.Limit {
+		msgs = msgs[len(msgs)-q.Limit:]
+	}
+	return msgs, nil
+}
+
+// Presence returns the joins and parts recorded between since (inclusive) and
+// until (exclusive), oldest first. A zero until means no upper bound.
+func (a *Archive) Presence(since, until time.Time) ([]ArchivedPresence, error) {
+	var events []ArchivedPresence
+	err := a.view(func(b *bolt.Bucket) error {
+		c := b.Bucket(archivePresence).Cursor()
+		for k, v := c.Seek(timeKey(since)); k != nil; k, v = c.Next() {
+			if !until.IsZero() && bytes.Compare(k[:8], timeKey(until)) >= 0 {
+				break
+			}
+			var event ArchivedPresence
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// candidates returns the IDs of the messages that may match q, using the most
+// selective index the query allows.
+func (a *Archive) candidates(b *bolt.Bucket, q ArchiveQuery) []snowflake.Snowflake {
+	var ids []snowflake.Snowflake
+	switch {
+	case q.Thread != 0:
+		ids = append(ids, q.Thread)
+		replies := b.Bucket(archiveReplies)
+		for i := 0; i < len(ids); i++ {
+			prefix := idKey(ids[i])
+			c := replies.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				ids = append(ids, keyID(k[8:]))
+			}
+		}
+	case q.Sender != "":
+		prefix := senderPrefix(q.Sender)
+		c := b.Bucket(archiveSenders).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ids = append(ids, keyID(k[len(prefix):]))
+		}
+	default:
+		c := b.Bucket(archiveTimes).Cursor()
+		for k, _ := c.Seek(timeKey(q.Since)); k != nil; k, _ = c.Next() {
+			if !q.Until.IsZero() && bytes.Compare(k[:8], timeKey(q.Until)) >= 0 {
+				break
+			}
+			ids = append(ids, keyID(k[8:]))
+		}
+	}
+	return ids
+}
+
+// matches reports whether msg satisfies the time and sender conditions of q.
+// Thread membership is decided by the replies index.
+func (q ArchiveQuery) matches(msg *proto.Message) bool {
+	sent := time.Time(msg.UnixTime)
+	if !q.Since.IsZero() && sent.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !sent.Before(q.Until) {
+		return false
+	}
+	if q.Sender != "" && normalizeNick(msg.Sender.Name) != normalizeNick(q.Sender) {
+		return false
+	}
+	return true
+}
+
+// view calls fn with the room's archive bucket in a read-only transaction. fn
+// is not called if nothing has been archived for the room.
+func (a *Archive) view(fn func(b *bolt.Bucket) error) error {
+	return a.db.View(func(tx *bolt.Tx) error {
+		b, err := nestedBucket(tx, []string{archiveBucket, a.room}, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// update calls fn with the room's archive bucket in a read-write transaction,
+// creating the bucket and its indexes if needed.
+func (a *Archive) update(fn func(b *bolt.Bucket) error) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b, err := nestedBucket(tx, []string{archiveBucket, a.room}, true)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{archiveMessages, archiveTimes, archiveSenders, archiveReplies, archivePresence} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return fn(b)
+	})
+}
+
+// archiveRecord is a message or a join or part waiting to be archived.
+type archiveRecord struct {
+	msg      *proto.Message
+	presence *ArchivedPresence
+}
+
+// write stores records in a single transaction.
+func (a *Archive) write(records []archiveRecord) error {
+	return a.update(func(b *bolt.Bucket) error {
+		for _, rec := range records {
+			var err error
+			if rec.msg != nil {
+				err = a.putMessage(b, rec.msg)
+			} else {
+				err = putPresence(b, rec.presence)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putMessage stores msg in the archive bucket b, replacing any earlier
+// version, and indexes it for queries and, if a.index is set, for search.
+func (a *Archive) putMessage(b *bolt.Bucket, msg *proto.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	id := idKey(msg.ID)
+	messages := b.Bucket(archiveMessages)
+	var prev *proto.Message
+	if old := messages.Get(id); old != nil {
+		prev = &proto.Message{}
+		if err := json.Unmarshal(old, prev); err != nil {
+			return err
+		}
+		if err := deleteIndexes(b, prev); err != nil {
+			return err
+		}
+	}
+	if err := messages.Put(id, data); err != nil {
+		return err
+	}
+	for _, index := range messageIndexes(msg) {
+		if err := b.Bucket(index.bucket).Put(index.key, []byte{}); err != nil {
+			return err
+		}
+	}
+	if !a.index {
+		return nil
+	}
+	return indexMessage(b.Tx(), a.room, prev, msg)
+}
+
+// putPresence records a join or part in the archive bucket b.
+func putPresence(b *bolt.Bucket, event *ArchivedPresence) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	presence := b.Bucket(archivePresence)
+	seq, err := presence.NextSequence()
+	if err != nil {
+		return err
+	}
+	return presence.Put(append(timeKey(event.Time), idKey(snowflake.Snowflake(seq))...), data)
+}
+
+// byID sorts messages by ID, which is also the order they were sent in.
+type byID []proto.Message
+
+func (m byID) Len() int           { return len(m) }
+func (m byID) Less(i, j int) bool { return m[i].ID < m[j].ID }
+func (m byID) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+type archiveIndex struct {
+	bucket []byte
+	key    []byte
+}
+
+// messageIndexes returns the index entries for msg.
+func messageIndexes(msg *proto.Message) []archiveIndex {
+	id := idKey(msg.ID)
+	indexes := []archiveIndex{
+		{archiveTimes, append(timeKey(time.Time(msg.UnixTime)), id...)},
+		{archiveSenders, append(senderPrefix(msg.Sender.Name), id...)},
+	}
+	if msg.Parent != 0 {
+		indexes = append(indexes, archiveIndex{archiveReplies, append(idKey(msg.Parent), id...)})
+	}
+	return indexes
+}
+
+func deleteIndexes(b *bolt.Bucket, msg *proto.Message) error {
+	for _, index := range messageIndexes(msg) {
+		if err := b.Bucket(index.bucket).Delete(index.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func idKey(id snowflake.Snowflake) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func keyID(key []byte) snowflake.Snowflake {
+	return snowflake.Snowflake(binary.BigEndian.Uint64(key))
+}
+
+// timeKey encodes t so that keys sort in time order. The zero time sorts
+// first.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if !t.IsZero() && t.UnixNano() > 0 {
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
+
+func senderPrefix(nick string) []byte {
+	return append([]byte(normalizeNick(nick)), 0)
+}
+
+// archive queues messages, edits, joins and parts for archiveLoop if the room
+// is archived. It runs in the dispatcher before the event reaches the
+// handlers, and never blocks it.
+func (r *Room) archive(ev *Event) {
+	if r.archiveQueue == nil {
+		return
+	}
+	switch ev.Type() {
+	case proto.SendEventType, proto.SendReplyType, proto.EditMessageEventType,
+		proto.JoinEventType, proto.PartEventType:
+	default:
+		return
+	}
+	if ev.packet.Error != "" {
+		return
+	}
+	payload, err := ev.Payload()
+	if err != nil {
+		return
+	}
+	var rec archiveRecord
+	switch e := payload.(type) {
+	case *proto.SendEvent:
+		msg := proto.Message(*e)
+		rec.msg = &msg
+	case *proto.SendReply:
+		msg := proto.Message(*e)
+		rec.msg = &msg
+	case *proto.EditMessageEvent:
+		msg := e.Message
+		rec.msg = &msg
+	case *proto.PresenceEvent:
+		rec.presence = &ArchivedPresence{
+			Time:    time.Now(),
+			Type:    ev.Type(),
+			Session: proto.SessionView(*e),
+		}
+	default:
+		return
+	}
+	select {
+	case r.archiveQueue <- rec:
+	default:
+		r.Logger.Warningf("Archive queue is full, not archiving %s packet", ev.Type())
+	}
+}
+
+// archiveLoop writes queued records to the room's archive until the room's
+// context is finished, and then writes what is left. Records that queued up
+// during a write are written together in the next transaction.
+func (r *Room) archiveLoop() {
+	defer r.Ctx.WaitGroup().Done()
+	a := r.Archive()
+	a.index = r.search
+	for {
+		var records []archiveRecord
+		select {
+		case rec := <-r.archiveQueue:
+			records = append(records, rec)
+		case <-r.Ctx.Done():
+		}
+		done := !r.Ctx.Alive()
+	drain:
+		for {
+			select {
+			case rec := <-r.archiveQueue:
+				records = append(records, rec)
+			default:
+				break drain
+			}
+		}
+		if len(records) > 0 {
+			if err := a.write(records); err != nil {
+				r.Logger.Errorf("Error archiving %d packets: %s", len(records), err)
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
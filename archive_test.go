@@ -0,0 +1,188 @@
+package gobot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/boltdb/bolt"
+	. "gopkg.in/check.v1"
+)
+
+type ArchiveSuite struct {
+	dir string
+	db  *bolt.DB
+}
+
+var _ = Suite(&ArchiveSuite{})
+
+func (s *ArchiveSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "gobot-archive")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.db, err = bolt.Open(filepath.Join(dir, "test.db"), 0666, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *ArchiveSuite) TearDownTest(c *C) {
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+var archiveEpoch = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// archived returns a message sent by nick, id minutes after archiveEpoch.
+func archived(id, parent snowflake.Snowflake, nick, content string) proto.Message {
+	msg := message(id, content)
+	msg.Parent = parent
+	msg.Sender.Name = nick
+	msg.UnixTime = proto.Time(archiveEpoch.Add(time.Duration(id) * time.Minute))
+	return msg
+}
+
+// putMessage archives msg as the room's archive writer would.
+func putMessage(c *C, a *Archive, msg proto.Message) {
+	c.Assert(a.write([]archiveRecord{{msg: &msg}}), IsNil)
+}
+
+func (s *ArchiveSuite) fill(c *C) *Archive {
+	a := &Archive{db: s.db, room: "test"}
+	for _, msg := range []proto.Message{
+		archived(1, 0, "alice", "hello"),
+		archived(2, 1, "Bob", "hi alice"),
+		archived(3, 0, "carol", "unrelated"),
+		archived(4, 2, "alice", "how are you"),
+		archived(5, 3, "bob", "indeed"),
+	} {
+		putMessage(c, a, msg)
+	}
+	return a
+}
+
+func (s *ArchiveSuite) TestQueries(c *C) {
+	a := s.fill(c)
+	for _, t := range []struct {
+		q    ArchiveQuery
+		want []snowflake.Snowflake
+	}{
+		{ArchiveQuery{}, []snowflake.Snowflake{1, 2, 3, 4, 5}},
+		{ArchiveQuery{Limit: 2}, []snowflake.Snowflake{4, 5}},
+		{ArchiveQuery{Since: archiveEpoch.Add(2 * time.Minute), Until: archiveEpoch.Add(4 * time.Minute)}, []snowflake.Snowflake{2, 3}},
+		{ArchiveQuery{Sender: "bob"}, []snowflake.Snowflake{2, 5}},
+		{ArchiveQuery{Sender: "bob", Until: archiveEpoch.Add(5 * time.Minute)}, []snowflake.Snowflake{2}},
+		{ArchiveQuery{Thread: 1}, []snowflake.Snowflake{1, 2, 4}},
+		{ArchiveQuery{Thread: 1, Sender: "alice"}, []snowflake.Snowflake{1, 4}},
+		{ArchiveQuery{Thread: 9}, []snowflake.Snowflake{}},
+	} {
+		msgs, err := a.Messages(t.q)
+		c.Check(err, IsNil)
+		c.Check(messageIDs(msgs), DeepEquals, t.want, Commentf("%+v", t.q))
+	}
+
+	empty := &Archive{db: s.db, room: "other"}
+	msgs, err := empty.Messages(ArchiveQuery{})
+	c.Check(err, IsNil)
+	c.Check(msgs, HasLen, 0)
+}
+
+func (s *ArchiveSuite) TestEdit(c *C) {
+	a := s.fill(c)
+	edited := archived(2, 3, "dave", "moved")
+	putMessage(c, a, edited)
+
+	msg, ok, err := a.Message(2)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(msg.Content, Equals, "moved")
+	msgs, err := a.Messages(ArchiveQuery{Sender: "bob"})
+	c.Check(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{5})
+	msgs, err = a.Messages(ArchiveQuery{Thread: 3})
+	c.Check(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{2, 3, 4, 5})
+}
+
+func (s *ArchiveSuite) TestRoom(c *C) {
+	s.db.Close()
+	b, err := NewBot(BotConfig{Name: "test", DbPath: filepath.Join(s.dir, "test.db")})
+	c.Assert(err, IsNil)
+	conn := &MockConn{
+		outgoing: make(chan *proto.Packet),
+		incoming: make(chan *proto.Packet),
+	}
+	b.AddRoom(RoomConfig{RoomName: "test", Conn: conn, Archive: true})
+	room, _ := b.Room("test")
+	go room.Run()
+
+	join, _ := MakePacket(proto.JoinEventType, proto.PresenceEvent(session("s1", "agent:a", "alice")))
+	send, _ := MakePacket(proto.SendEventType, proto.SendEvent(archived(13, 0, "alice", "hi")))
+	edit, _ := MakePacket(proto.EditMessageEventType, proto.EditMessageEvent{Message: archived(13, 0, "alice", "hello")})
+	part, _ := MakePacket(proto.PartEventType, proto.PresenceEvent(session("s1", "agent:a", "alice")))
+	for _, p := range []*proto.Packet{join, send, edit, part} {
+		conn.incoming <- p
+	}
+	waitFor(c, func() bool {
+		events, _ := room.Archive().Presence(time.Time{}, time.Time{})
+		return len(events) == 2
+	})
+	events, err := room.Archive().Presence(time.Time{}, time.Time{})
+	c.Check(err, IsNil)
+	c.Check(events[0].Type, Equals, proto.JoinEventType)
+	c.Check(events[1].Type, Equals, proto.PartEventType)
+	c.Check(events[1].Session.Name, Equals, "alice")
+	msg, ok, err := b.Archive("test").Message(13)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+	c.Check(msg.Content, Equals, "hello")
+	found, err := b.Archive("test").Search(SearchQuery{Terms: []string{"hello"}})
+	c.Check(err, IsNil)
+	c.Check(found, HasLen, 0)
+
+	b.Stop()
+	s.db, _ = bolt.Open(filepath.Join(s.dir, "test.db"), 0666, nil)
+}
+
+func (s *ArchiveSuite) TestSlowWritesDoNotBlockDispatch(c *C) {
+	s.db.Close()
+	b, err := NewBot(BotConfig{Name: "test", DbPath: filepath.Join(s.dir, "test.db")})
+	c.Assert(err, IsNil)
+	conn := &MockConn{
+		outgoing: make(chan *proto.Packet),
+		incoming: make(chan *proto.Packet),
+	}
+	b.AddRoom(RoomConfig{RoomName: "test", Conn: conn, Archive: true})
+	room, _ := b.Room("test")
+	h := newEventHandler()
+	room.Handlers = []Handler{h}
+	go room.Run()
+
+	// Hold the database's write lock, as a slow disk would.
+	tx, err := b.DB.Begin(true)
+	c.Assert(err, IsNil)
+	for i := 0; i < 5; i++ {
+		conn.incoming <- sendEvent("hi")
+		expectEvent(c, h.events, "send hi")
+	}
+	ping, _ := MakePacket(proto.PingEventType, proto.PingEvent{})
+	conn.incoming <- ping
+	select {
+	case p := <-conn.outgoing:
+		c.Check(p.Type, Equals, proto.PingReplyType)
+	case <-time.After(time.Second):
+		c.Error("ping was not answered while the archive was being written")
+	}
+	c.Assert(tx.Rollback(), IsNil)
+
+	send, _ := MakePacket(proto.SendEventType, proto.SendEvent(archived(13, 0, "alice", "hi")))
+	conn.incoming <- send
+	expectEvent(c, h.events, "send hi")
+	b.Stop()
+	s.db, err = bolt.Open(filepath.Join(s.dir, "test.db"), 0666, nil)
+	c.Assert(err, IsNil)
+	_, ok, err := (&Archive{db: s.db, room: "test"}).Message(13)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+}
@@ -3,7 +3,11 @@ package gobot
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"euphoria.io/heim/proto"
@@ -14,11 +18,6 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-const (
-	// MAXRETRIES is the number of times to retry a connection to euphoria.
-	MAXRETRIES = 5
-)
-
 // MakePacket is a convenience function that takes a payload and a PacketType
 // and returns a Packet. The message ID of the packet is NOT set.
 func MakePacket(msgType proto.PacketType, payload interface{}) (*proto.Packet, error) {
@@ -35,48 +34,109 @@ func MakePacket(msgType proto.PacketType, payload interface{}) (*proto.Packet, e
 }
 
 // Bot is the highest level abstraction- it contains and controls multiple Room
-// structs. Methods on Bot can add the bot to new rooms or, eventually, remove
-// them.
+// structs. Methods on Bot can add the bot to new rooms or remove them, either
+// before the bot is run or while it is running (see control.go).
 //
-// Bot exposes a bolt database for the use of the user. The basic bot does not
-// use the database, so there is no chance of collisions in bucket names or
-// key-value instances.
+// Rooms must not be read or written directly while the bot is running; use
+// Room, ListRooms, JoinRoom and LeaveRoom instead, which hold roomsMu.
+//
+// Bot exposes a bolt database for the use of the user. Handlers should prefer
+// the namespaced stores returned by Store, which keep their data apart. The
+// framework only uses buckets whose names start with "_gobot".
 type Bot struct {
 	Rooms   map[string]*Room
 	BotName string
 	ctx     scope.Context
 	DB      *bolt.DB
+	Storage Storage
 	Logger  *logrus.Logger
 	cmd     chan interface{}
+	roomsMu sync.RWMutex
+	limiter *tokenBucket
+
+	supervisors map[string]*supervisor
+	runErr      error
+	running     int32
+	server      ServerConfig
+	metrics     *metrics
 }
 
 // Room contains a connection to a euphoria room and uses Handlers to process
-// packets and optionally reply to them. The DB member points to the same DB
-// initialized by the parent Bot. The Ctx member is distinct from the Bot's ctx
-// member.
+// packets and optionally reply to them. The DB and Storage members point to the
+// same DB and Storage as the parent Bot's. The Ctx member is distinct from the
+// Bot's ctx member.
 type Room struct {
-	RoomName string
-	conn     Connection
-	Ctx      scope.Context
-	password string
-	outbound chan *proto.Packet
-	inbound  chan *proto.Packet
-	Handlers []Handler
-	msgID    int
-	BotName  string
-	Logger   *logrus.Logger
-	DB       *bolt.DB
+	*roomState
+	RoomName     string
+	conn         Connection
+	Ctx          scope.Context
+	password     string
+	outbound     chan *proto.Packet
+	priority     chan *proto.Packet
+	inbound      chan *proto.Packet
+	limiter      *tokenBucket
+	botLimiter   *tokenBucket
+	reconnect    ReconnectPolicy
+	Handlers     []Handler
+	history      *messageCache
+	BotName      string
+	Logger       *logrus.Logger
+	DB           *bolt.DB
+	Storage      Storage
+	cfg          RoomConfig
+	server       ServerConfig
+	metrics      *metrics
+	archiveQueue chan archiveRecord
+	search       bool
+
+	// pausable marks the Room passed to a handler that is suspended while
+	// the room is paused; see Pause.
+	pausable bool
+}
+
+// roomState is the state of a Room that changes while it runs. It is shared
+// by the copies of the Room passed to its handlers.
+type roomState struct {
+	queued       int64
+	workers      []*handlerWorker
+	workersMu    sync.RWMutex
+	stopHandlers sync.Once
+	shutdownOnce sync.Once
+	msgID        int
+	msgMu        sync.Mutex
+	pending      map[string]chan *proto.Packet
+	roster       roster
+	stopFlag     int32
+	paused       int32
+	state        int32
 }
 
 // BotConfig controls the configuration of a new Bot when it is created by the
 // user.
+//
+// RateLimit, if set, limits the packets sent by all of the bot's rooms
+// together. Each room may also have its own RateLimit.
+//
+// Server selects the heim server for all of the bot's rooms; see ServerConfig.
+//
+// Metrics, if set, is the address of a local HTTP listener, such as
+// "localhost:9100", on which the bot serves metrics about its rooms, handlers
+// and connections in the Prometheus text format at MetricsPath.
+//
+// Admin enables the admin HTTP API; see AdminConfig.
 type BotConfig struct {
-	Name   string `yaml:"Name"`
-	DbPath string `yaml:"DbPath"`
+	Name      string       `yaml:"Name"`
+	DbPath    string       `yaml:"DbPath"`
+	RateLimit *RateLimit   `yaml:"RateLimit,omitempty"`
+	Server    ServerConfig `yaml:"Server,omitempty"`
+	Metrics   string       `yaml:"Metrics,omitempty"`
+	Admin     AdminConfig  `yaml:"Admin,omitempty"`
 }
 
 // NewBot creates a bot with the given configuration. It will create a bolt DB
 // if it does not already exist at the specified location.
+// Migrations registered with RegisterMigrations are applied to the DB before
+// NewBot returns.
 func NewBot(cfg BotConfig) (*Bot, error) {
 	db, err := bolt.Open(cfg.DbPath, 0666, nil)
 	if err != nil {
@@ -85,61 +145,203 @@ func NewBot(cfg BotConfig) (*Bot, error) {
 	ctx := scope.New()
 	logger := logrus.New()
 	logger.Level = logrus.DebugLevel
+	if err := migrations.run(db, logger); err != nil {
+		db.Close()
+		return nil, err
+	}
 	cmd := make(chan interface{})
 	rooms := make(map[string]*Room)
-	return &Bot{
-		Rooms:   rooms,
-		BotName: cfg.Name,
-		ctx:     ctx,
-		DB:      db,
-		Logger:  logger,
-		cmd:     cmd,
-	}, nil
+	b := &Bot{
+		Rooms:       rooms,
+		BotName:     cfg.Name,
+		ctx:         ctx,
+		DB:          db,
+		Storage:     NewBoltStorage(db),
+		Logger:      logger,
+		cmd:         cmd,
+		supervisors: make(map[string]*supervisor),
+		limiter:     newTokenBucket(cfg.RateLimit),
+		server:      cfg.Server,
+		metrics:     newMetrics(),
+	}
+	if cfg.Metrics != "" {
+		if err := b.serveMetrics(cfg.Metrics); err != nil {
+			b.ctx.Cancel()
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := b.serveAdmin(cfg.Admin); err != nil {
+		b.ctx.Cancel()
+		db.Close()
+		return nil, err
+	}
+	return b, nil
 }
 
 // RoomConfig controls the configuration of a new Room when it is added to a Bot.
+//
+// Restart selects the RestartPolicy applied when the room's Run method returns.
+// MaxRestarts limits the number of restarts (zero means no limit), and the
+// delay between restarts doubles from RestartBackoff up to MaxRestartBackoff.
+//
+// ReconnectPolicy controls how the room's connection retries after losing its
+// connection. If it is nil, the Reconnect settings are used, and if those are
+// not set either, DefaultReconnectPolicy.
+//
+// Dispatch sets the default DispatchOptions for the room's handlers.
+//
+// HistorySize is the number of recent messages cached for Room.History. Zero
+// means DefaultHistorySize and a negative size disables the cache.
+//
+// Server overrides the bot's ServerConfig for this room.
+//
+// Transcript, if set, is the path of a file to which all packets sent and
+// received by the room are appended; see RecordingConnection.
+//
+// Archive records the room's messages, edits, joins and parts in the bot's
+// database; see Archive. Search also indexes the archived messages for
+// Archive.Search, and requires Archive.
 type RoomConfig struct {
-	RoomName     string `yaml:"RoomName"`
-	Password     string `yaml:"Password,omitempty"`
-	AddlHandlers []Handler
-	Conn         Connection
+	RoomName          string              `yaml:"RoomName"`
+	Password          string              `yaml:"Password,omitempty"`
+	Restart           RestartPolicy       `yaml:"Restart,omitempty"`
+	MaxRestarts       int                 `yaml:"MaxRestarts,omitempty"`
+	RestartBackoff    time.Duration       `yaml:"RestartBackoff,omitempty"`
+	MaxRestartBackoff time.Duration       `yaml:"MaxRestartBackoff,omitempty"`
+	Reconnect         *ExponentialBackoff `yaml:"Reconnect,omitempty"`
+	RateLimit         *RateLimit          `yaml:"RateLimit,omitempty"`
+	Dispatch          DispatchOptions     `yaml:"Dispatch,omitempty"`
+	HistorySize       int                 `yaml:"HistorySize,omitempty"`
+	Server            ServerConfig        `yaml:"Server,omitempty"`
+	Transcript        string              `yaml:"Transcript,omitempty"`
+	Archive           bool                `yaml:"Archive,omitempty"`
+	Search            bool                `yaml:"Search,omitempty"`
+	ReconnectPolicy   ReconnectPolicy     `yaml:"-"`
+	AddlHandlers      []Handler
+	Conn              Connection
 }
 
 // AddRoom adds a new Room to the bot with the given configuration. The context
-// for this room is distinct from the Bot's context.
+// for this room is distinct from the Bot's context. AddRoom does not start the
+// room; use JoinRoom to add and start a room while the bot is running.
 func (b *Bot) AddRoom(cfg RoomConfig) {
-	b.Logger.Debugf("%s", len(cfg.AddlHandlers))
+	room := b.newRoom(cfg)
+	b.roomsMu.Lock()
+	b.Rooms[room.RoomName] = room
+	b.roomsMu.Unlock()
+}
+
+// RemoveRoom stops the named room, if it exists, and removes it from the bot.
+// The room will not be restarted by its supervisor.
+func (b *Bot) RemoveRoom(roomName string) error {
+	b.roomsMu.Lock()
+	room, ok := b.Rooms[roomName]
+	if !ok {
+		b.roomsMu.Unlock()
+		return fmt.Errorf("No such room: %s", roomName)
+	}
+	delete(b.Rooms, roomName)
+	sup, supervised := b.supervisors[roomName]
+	delete(b.supervisors, roomName)
+	b.roomsMu.Unlock()
+	if supervised && sup.halt() {
+		return nil
+	}
+	return room.Stop()
+}
+
+// Room returns the room with the given name and whether it exists.
+func (b *Bot) Room(roomName string) (*Room, bool) {
+	b.roomsMu.RLock()
+	defer b.roomsMu.RUnlock()
+	room, ok := b.Rooms[roomName]
+	return room, ok
+}
+
+// rooms returns a snapshot of the bot's rooms that is safe to range over
+// without holding roomsMu.
+func (b *Bot) rooms() []*Room {
+	b.roomsMu.RLock()
+	defer b.roomsMu.RUnlock()
+	rooms := make([]*Room, 0, len(b.Rooms))
+	for _, room := range b.Rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// newRoom builds a Room with a fresh context and channels from the given
+// configuration. The room is not registered with the bot.
+func (b *Bot) newRoom(cfg RoomConfig) *Room {
+	b.Logger.Debugf("Creating room %s with %d handlers", cfg.RoomName, len(cfg.AddlHandlers))
 	ctx := scope.New()
 	logger := logrus.New()
 	logger.Level = logrus.InfoLevel
 	room := Room{
-		RoomName: cfg.RoomName,
-		password: cfg.Password,
-		Ctx:      ctx,
-		outbound: make(chan *proto.Packet, 5),
-		inbound:  make(chan *proto.Packet, 5),
-		BotName:  b.BotName,
-		msgID:    0,
-		Logger:   logger,
-		Handlers: cfg.AddlHandlers,
-		DB:       b.DB,
-		conn:     cfg.Conn,
+		roomState: &roomState{
+			pending: make(map[string]chan *proto.Packet),
+		},
+		RoomName:   cfg.RoomName,
+		password:   cfg.Password,
+		Ctx:        ctx,
+		outbound:   make(chan *proto.Packet, 5),
+		priority:   make(chan *proto.Packet, 5),
+		inbound:    make(chan *proto.Packet, 5),
+		limiter:    newTokenBucket(cfg.RateLimit),
+		botLimiter: b.limiter,
+		reconnect:  cfg.reconnectPolicy(),
+		BotName:    b.BotName,
+		history:    newMessageCache(cfg.HistorySize),
+		server:     cfg.Server.merge(b.server),
+		Logger:     logger,
+		Handlers:   cfg.AddlHandlers,
+		DB:         b.DB,
+		Storage:    b.Storage,
+		metrics:    b.metrics,
+		conn:       cfg.Conn,
+		cfg:        cfg,
+	}
+	if cfg.Archive && b.DB != nil {
+		room.archiveQueue = make(chan archiveRecord, archiveQueueSize)
+		room.search = cfg.Search
 	}
-	b.Rooms[room.RoomName] = &room
+	if cfg.Transcript != "" && cfg.Conn != nil {
+		conn, err := RecordToFile(cfg.Conn, cfg.Transcript)
+		if err != nil {
+			b.Logger.Errorf("Error opening transcript for room %s: %s", cfg.RoomName, err)
+		} else {
+			room.conn = conn
+		}
+	}
+	return &room
 }
 
+// sendLoop writes queued packets to the connection. Packets on the priority
+// channel (ping replies and the pings measuring latency) are always sent first
+// and skip the rate limiters.
 func (r *Room) sendLoop() {
 	defer r.Ctx.WaitGroup().Done()
 	for {
+		select {
+		case msg := <-r.priority:
+			if !r.send(msg) {
+				return
+			}
+			continue
+		default:
+		}
 		select {
 		case <-r.Ctx.Done():
 			r.Logger.Debugln("sendLoop exiting...")
 			return
+		case msg := <-r.priority:
+			if !r.send(msg) {
+				return
+			}
 		case msg := <-r.outbound:
-			r.Logger.Debugf("Sending message of type %s...", msg.Type)
-			if _, err := r.conn.SendJSON(r, msg); err != nil {
-				logrus.Errorf("Error sending JSON, terminating room: %s", err)
-				r.Ctx.Terminate(err)
+			if !r.waitForToken() || !r.send(msg) {
+				r.Logger.Debugln("sendLoop exiting...")
 				return
 			}
 		}
@@ -147,40 +349,59 @@ func (r *Room) sendLoop() {
 
 }
 
+// send writes a single packet to the connection and terminates the room on
+// error.
+func (r *Room) send(msg *proto.Packet) bool {
+	atomic.AddInt64(&r.queued, -1)
+	r.Logger.Debugf("Sending message of type %s...", msg.Type)
+	if _, err := r.conn.SendJSON(r, msg); err != nil {
+		logrus.Errorf("Error sending JSON, terminating room: %s", err)
+		r.Ctx.Terminate(err)
+		return false
+	}
+	r.metrics.packetSent(r.RoomName, msg.Type)
+	return true
+}
+
 func (r *Room) recvLoop() {
 	defer r.Ctx.WaitGroup().Done()
 	for {
-		pchan := make(chan *proto.Packet)
+		// The channel is buffered and never closed, so that a ReceiveJSON
+		// still reading when the room stops can send without blocking.
+		pchan := make(chan *proto.Packet, 1)
 		go r.conn.ReceiveJSON(r, pchan)
 		select {
 		case <-r.Ctx.Done():
 			r.Logger.Debugln("recvLoop exiting...")
-			close(pchan)
 			return
 		case p := <-pchan:
-			if p != nil {
-				r.inbound <- p
+			if p == nil {
+				continue
+			}
+			r.metrics.packetReceived(r.RoomName, p.Type)
+			// Flood errors only slow the limiters down; they are not fatal.
+			if r.checkFlood(p) {
+				r.deliverReply(p)
+				continue
+			}
+			// A failed reply belongs to the caller waiting on it and must not
+			// be treated as fatal by the dispatcher.
+			if r.deliverReply(p) && p.Error != "" {
+				continue
+			}
+			select {
+			case r.inbound <- p:
+			case <-r.Ctx.Done():
+				r.Logger.Debugln("recvLoop exiting...")
+				return
 			}
 		}
 	}
 }
 
-func (r *Room) runHandlerIncoming(handler Handler, p proto.Packet) {
-	r.Logger.Debugln("runHandlerIncoming")
-	retPacket, err := handler.HandleIncoming(r, &p)
-	if err != nil {
-		r.Logger.Errorf("Error in handler, shutting down room: %s", err)
-		r.Ctx.Terminate(err)
-		return
-	}
-	if retPacket != nil {
-		r.outbound <- retPacket
-	}
-}
-
-func (r *Room) handlePing(p *proto.Packet) error {
+func (r *Room) handlePing(ev *Event) error {
 	r.Logger.Debugln("Handling ping...")
-	raw, err := p.Payload()
+	raw, err := ev.Payload()
 	if err != nil {
 		return err
 	}
@@ -192,11 +413,9 @@ func (r *Room) handlePing(p *proto.Packet) error {
 	return nil
 }
 
-func (r *Room) handleBadPacket(p *proto.Packet) {
-	if p == nil {
-		return
-	}
-	payload, err := p.Payload()
+func (r *Room) handleBadPacket(ev *Event) {
+	p := ev.packet
+	payload, err := ev.Payload()
 	if err != nil {
 		r.Logger.Errorf("Could not extract payload: %s", payload)
 		r.Ctx.Cancel()
@@ -204,17 +423,17 @@ func (r *Room) handleBadPacket(p *proto.Packet) {
 	}
 	if p.Error != "" {
 		r.Logger.Errorf("Error in received packet of type %s: %s", p.Type, p.Error)
-		r.Ctx.Cancel()
+		r.Ctx.Terminate(fmt.Errorf("error in %s packet: %s", p.Type, p.Error))
 	}
 	switch msg := payload.(type) {
-	case proto.ErrorReply:
+	case *proto.ErrorReply:
 		r.Logger.Errorf("Error packet received: %s", msg.Error)
-		r.Ctx.Cancel()
-	case proto.BounceEvent:
+		r.Ctx.Terminate(fmt.Errorf("error packet received: %s", msg.Error))
+	case *proto.BounceEvent:
 		r.Logger.Errorf("Bounced: %s", msg.Reason)
-	case proto.DisconnectEvent:
+	case *proto.DisconnectEvent:
 		r.Logger.Errorf("disconnect-event received: reason: %s", msg.Reason)
-		r.Ctx.Cancel()
+		r.Ctx.Terminate(fmt.Errorf("disconnect-event received: %s", msg.Reason))
 	}
 }
 
@@ -227,19 +446,20 @@ func (r *Room) dispatcher() {
 			return
 		case p := <-r.inbound:
 			r.Logger.Debugf("Dispatching packet of type %s", p.Type)
+			ev := newEvent(p)
 			if p.Type == proto.PingEventType {
-				err := r.handlePing(p)
+				err := r.handlePing(ev)
 				if err != nil {
 					r.Logger.Errorf("Error handling ping, shutting down room: %s", err)
 					r.Ctx.Terminate(err)
 					return
 				}
 			}
-			r.handleBadPacket(p)
-			for _, handler := range r.Handlers {
-				r.Logger.Debugln("Running handler...")
-				r.runHandlerIncoming(handler, *p)
-			}
+			r.handleBadPacket(ev)
+			r.trackPresence(ev)
+			r.trackHistory(ev)
+			r.archive(ev)
+			r.dispatch(ev)
 		}
 	}
 }
@@ -251,14 +471,27 @@ func (r *Room) queuePayload(payload interface{}, pType proto.PacketType) string
 		r.Ctx.Terminate(err)
 		return ""
 	}
-	msg.ID = strconv.Itoa(r.msgID)
-	r.msgID++
+	msg.ID = r.nextID()
+	queue := r.outbound
+	if pType == proto.PingReplyType {
+		queue = r.priority
+	}
+	atomic.AddInt64(&r.queued, 1)
 	go func() {
-		r.outbound <- msg
+		queue <- msg
 	}()
 	return msg.ID
 }
 
+// nextID returns a new client-side packet ID, unique within the room.
+func (r *Room) nextID() string {
+	r.msgMu.Lock()
+	defer r.msgMu.Unlock()
+	id := strconv.Itoa(r.msgID)
+	r.msgID++
+	return id
+}
+
 func (r *Room) sendNick() (string, error) {
 	payload := proto.NickCommand{Name: r.BotName}
 	msgID := r.queuePayload(payload, proto.NickType)
@@ -285,6 +518,10 @@ func (r *Room) SendText(parent *snowflake.Snowflake, msg string) (string, error)
 	if parent != nil {
 		payload.Parent = *parent
 	}
+	if r.held(proto.SendType) {
+		r.Logger.Debugf("Room is paused, dropping message with text: %s", msg)
+		return "", ErrPaused
+	}
 	r.Logger.Debugf("Putting message in outgoing queue with text: %s", msg)
 	msgID := r.queuePayload(payload, proto.SendType)
 	return msgID, nil
@@ -299,61 +536,120 @@ func (r *Room) Run() error {
 	r.Ctx.WaitGroup().Add(1)
 	go r.sendLoop()
 
+	r.setState(RoomConnecting)
 	if err := r.conn.Connect(r); err != nil {
+		r.setState(RoomStopped)
 		r.Ctx.Terminate(err)
 		r.Logger.Errorf("Error on initial connect to room: %s", err)
 		r.Ctx.WaitGroup().Wait()
 		return err
 	}
+	r.setState(RoomConnected)
 	r.Ctx.WaitGroup().Add(1)
 	go r.recvLoop()
 
+	r.startWorkers()
 	r.Ctx.WaitGroup().Add(1)
 	go r.dispatcher()
-
-	for _, handler := range r.Handlers {
-		go handler.Run(r)
+	if r.archiveQueue != nil {
+		r.Ctx.WaitGroup().Add(1)
+		go r.archiveLoop()
 	}
+
 	<-r.Ctx.Done()
 	r.Logger.Warnf("Room %s's context is finished.", r.RoomName)
 	return fmt.Errorf("Fatal error in room %s: %s", r.RoomName, r.Ctx.Err())
 }
 
-// RunAllRooms runs room.Run() for all rooms registered with the bot. It will
-// only return when all rooms are exited- common usage will be running this as
-// a goroutine.
-func (b *Bot) RunAllRooms() {
+// RunAllRooms runs room.Run() for all rooms registered with the bot and then
+// serves control commands (see JoinRoom, LeaveRoom, RestartRoom and ListRooms)
+// until the bot is stopped. It returns nil when Stop is called and all rooms
+// are exited. It also returns once no room is left running without being
+// restarted: nil if the rooms were all stopped deliberately, e.g. by !kill,
+// and otherwise the errors of the rooms that failed. Common usage will be
+// running this as a goroutine.
+func (b *Bot) RunAllRooms() error {
 	go b.monitorLoop()
-	errChan := make(chan error, len(b.Rooms))
-	for _, room := range b.Rooms {
-		b.ctx.WaitGroup().Add(1)
-		go func(r *Room) {
-			defer b.ctx.WaitGroup().Done()
-			err := r.Run()
-			r.Logger.Errorf("Error in room %s: %s", room.RoomName, err)
-			if err = r.Stop(); err != nil {
-				r.Logger.Errorf("Error stopping room %s: %s", room.RoomName, err)
-			}
-			errChan <- err
-		}(room)
+	for _, room := range b.rooms() {
+		b.runRoom(room)
 	}
-	go func() {
-		b.ctx.WaitGroup().Wait()
-		b.Logger.Warnln("Bot waitgroup finished.")
-		close(errChan)
-	}()
-	for err := range errChan {
-		b.Logger.Errorf("%s", err)
+	atomic.StoreInt32(&b.running, 1)
+	b.controlLoop()
+	atomic.StoreInt32(&b.running, 0)
+	b.ctx.WaitGroup().Wait()
+	b.Logger.Warnln("Bot waitgroup finished.")
+	b.roomsMu.RLock()
+	defer b.roomsMu.RUnlock()
+	return b.runErr
+}
+
+// supervisorExited is called by each supervisor as it exits. If no other
+// supervisor is running, it cancels the bot's context, so that RunAllRooms
+// returns instead of serving a bot without rooms. RunAllRooms returns an error
+// if a room failed for good, and nil if every room was stopped deliberately,
+// e.g. by !kill. Supervisors halted by the bot itself, as LeaveRoom and the
+// admin API do, leave the bot running.
+func (b *Bot) supervisorExited(s *supervisor) {
+	b.roomsMu.Lock()
+	defer b.roomsMu.Unlock()
+	s.finished = true
+	if s.stopped() || !b.ctx.Alive() {
+		return
+	}
+	var errs []string
+	for _, name := range sortedSupervisors(b.supervisors) {
+		sup := b.supervisors[name]
+		if !sup.finished {
+			return
+		}
+		if sup.err != nil {
+			errs = append(errs, sup.err.Error())
+		}
 	}
+	if len(errs) == 0 {
+		b.Logger.Infoln("No rooms left running, stopping the bot")
+		b.ctx.Cancel()
+		return
+	}
+	b.runErr = fmt.Errorf("No rooms left running: %s", strings.Join(errs, "; "))
+	b.Logger.Errorf("%s, stopping the bot", b.runErr)
+	b.ctx.Cancel()
+}
+
+func sortedSupervisors(sups map[string]*supervisor) []string {
+	names := make([]string, 0, len(sups))
+	for name := range sups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runRoom runs the room under a new supervisor in a goroutine that is tracked
+// by the bot's WaitGroup. The supervisor stops the room once Run returns and
+// restarts it according to the room's RestartPolicy.
+func (b *Bot) runRoom(room *Room) {
+	sup := newSupervisor(b, room)
+	b.roomsMu.Lock()
+	b.supervisors[room.RoomName] = sup
+	b.roomsMu.Unlock()
+	b.ctx.WaitGroup().Add(1)
+	go sup.run()
 }
 
+// monitorLoop periodically measures the round trip to the server until the
+// room's context is finished.
 func (r *Room) monitorLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 	for {
-		<-time.After(120 * time.Second)
-		if r.Ctx.Alive() {
-			r.Logger.Debugln("Context is alive.")
-		} else {
+		select {
+		case <-r.Ctx.Done():
 			r.Logger.Debugln("Context is dead.")
+			return
+		case <-ticker.C:
+			r.Logger.Debugln("Context is alive.")
+			r.measurePing()
 		}
 	}
 }
@@ -370,24 +666,51 @@ func (b *Bot) monitorLoop() {
 }
 
 // Stop cancels a Room's context, closes the connection, and waits for all
-// goroutines spawned by the Room to stop.
+// goroutines spawned by the Room to stop. A room stopped this way is never
+// restarted by its supervisor.
 func (r *Room) Stop() error {
-	r.Logger.Warningf("Room '%s' shutting down", r.RoomName)
-	r.Ctx.Cancel()
-	r.Logger.Debugln("Closing connection...")
-	if err := r.conn.Close(); err != nil {
-		r.Logger.Debugf("Error closing connection: %s", err)
-		return err
-	}
-	r.Logger.Debugln("Waiting for graceful shutdown...")
-	r.Ctx.WaitGroup().Wait()
-	return nil
+	atomic.StoreInt32(&r.stopFlag, 1)
+	return r.shutdown()
+}
+
+func (r *Room) stopRequested() bool {
+	return atomic.LoadInt32(&r.stopFlag) == 1
+}
+
+// shutdown cancels the room's context, closes the connection, waits for the
+// room's goroutines and stops its handlers. Only the first call does so, and
+// returns the error from closing the connection, if any; later calls wait for
+// it to finish and return nil.
+func (r *Room) shutdown() (err error) {
+	r.shutdownOnce.Do(func() {
+		r.Logger.Warningf("Room '%s' shutting down", r.RoomName)
+		r.setState(RoomStopped)
+		r.Ctx.Cancel()
+		r.Logger.Debugln("Closing connection...")
+		if err = r.conn.Close(); err != nil {
+			r.Logger.Debugf("Error closing connection: %s", err)
+		}
+		r.Logger.Debugln("Waiting for graceful shutdown...")
+		r.Ctx.WaitGroup().Wait()
+		r.callHandlerStop()
+	})
+	return err
 }
 
-// Stop runs Room.Stop() for all rooms registered with the bot, cancels the
-// bot's context, and waits for all goroutines to exit before closing the DB.
+// Stop halts the bot's supervisors, so that no room is restarted, runs
+// Room.Stop() for all rooms registered with the bot, cancels the bot's
+// context, and waits for all goroutines to exit before closing the DB.
 func (b *Bot) Stop() {
-	for _, room := range b.Rooms {
+	b.roomsMu.RLock()
+	sups := make([]*supervisor, 0, len(b.supervisors))
+	for _, sup := range b.supervisors {
+		sups = append(sups, sup)
+	}
+	b.roomsMu.RUnlock()
+	for _, sup := range sups {
+		sup.halt()
+	}
+	for _, room := range b.rooms() {
 		if err := room.Stop(); err != nil {
 			b.Logger.Errorf("Error stopping room: %s", err)
 		}
@@ -0,0 +1,170 @@
+package gobot
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+)
+
+// DefaultCallTimeout is used by Call and its helpers when they are given a
+// timeout of zero or less. It is well under DefaultHandlerTimeout, so that a
+// handler whose call times out can still return before its own deadline.
+const DefaultCallTimeout = 5 * time.Second
+
+// ErrCallTimeout is returned by Call when the server does not reply within the
+// timeout.
+var ErrCallTimeout = errors.New("timed out waiting for reply")
+
+// ServerError is returned by Call when the server answers a command with an
+// error instead of a payload.
+type ServerError struct {
+	Type    proto.PacketType
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error in %s: %s", e.Type, e.Message)
+}
+
+// Call sends a command to the server and waits for the reply packet with the
+// same ID. It returns the reply's decoded payload, e.g. *proto.SendReply for a
+// send command, or a *ServerError if the server rejected the command.
+//
+// Replies are matched as they are received, before they are dispatched, so
+// Call may be used from a Handler. The reply packet is still passed on to the
+// room's handlers unless it carries an error.
+func (r *Room) Call(pType proto.PacketType, payload interface{}, timeout time.Duration) (interface{}, error) {
+	return r.call(r.outbound, pType, payload, timeout)
+}
+
+// call implements Call, sending the command on the given queue.
+func (r *Room) call(queue chan *proto.Packet, pType proto.PacketType, payload interface{}, timeout time.Duration) (interface{}, error) {
+	if timeout <= 0 {
+		timeout = DefaultCallTimeout
+	}
+	if r.held(pType) {
+		return nil, ErrPaused
+	}
+	msg, err := MakePacket(pType, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.ID = r.nextID()
+	reply := make(chan *proto.Packet, 1)
+	r.msgMu.Lock()
+	r.pending[msg.ID] = reply
+	r.msgMu.Unlock()
+	defer func() {
+		r.msgMu.Lock()
+		delete(r.pending, msg.ID)
+		r.msgMu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	atomic.AddInt64(&r.queued, 1)
+	select {
+	case queue <- msg:
+	case <-timer.C:
+		atomic.AddInt64(&r.queued, -1)
+		return nil, ErrCallTimeout
+	case <-r.Ctx.Done():
+		atomic.AddInt64(&r.queued, -1)
+		return nil, r.Ctx.Err()
+	}
+	select {
+	case p := <-reply:
+		if p.Error != "" {
+			return nil, &ServerError{Type: p.Type, Message: p.Error}
+		}
+		return p.Payload()
+	case <-timer.C:
+		return nil, ErrCallTimeout
+	case <-r.Ctx.Done():
+		return nil, r.Ctx.Err()
+	}
+}
+
+// deliverReply hands a received packet to the Call waiting on its ID and
+// reports whether there was one.
+func (r *Room) deliverReply(p *proto.Packet) bool {
+	if p.ID == "" {
+		return false
+	}
+	r.msgMu.Lock()
+	reply, ok := r.pending[p.ID]
+	delete(r.pending, p.ID)
+	r.msgMu.Unlock()
+	if !ok {
+		return false
+	}
+	reply <- p
+	return true
+}
+
+// SendTextSync sends a text message like SendText and waits for the server's
+// send-reply, which carries the message's snowflake ID.
+func (r *Room) SendTextSync(parent *snowflake.Snowflake, msg string, timeout time.Duration) (*proto.SendReply, error) {
+	payload := &proto.SendCommand{
+		Content: msg,
+	}
+	if parent != nil {
+		payload.Parent = *parent
+	}
+	raw, err := r.Call(proto.SendType, payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := raw.(*proto.SendReply)
+	if !ok {
+		return nil, fmt.Errorf("Could not assert payload as *proto.SendReply")
+	}
+	return reply, nil
+}
+
+// NickSync asks the server to change the bot's nick in this room and waits for
+// the nick-reply. BotName is not changed; callers that want mentions of the new
+// nick to be recognized should update it themselves.
+func (r *Room) NickSync(name string, timeout time.Duration) (*proto.NickReply, error) {
+	raw, err := r.Call(proto.NickType, proto.NickCommand{Name: name}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := raw.(*proto.NickReply)
+	if !ok {
+		return nil, fmt.Errorf("Could not assert payload as *proto.NickReply")
+	}
+	return reply, nil
+}
+
+// WhoSync asks the server for the sessions in the room and waits for the
+// who-reply.
+func (r *Room) WhoSync(timeout time.Duration) (*proto.WhoReply, error) {
+	raw, err := r.Call(proto.WhoType, proto.WhoCommand{}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := raw.(*proto.WhoReply)
+	if !ok {
+		return nil, fmt.Errorf("Could not assert payload as *proto.WhoReply")
+	}
+	return reply, nil
+}
+
+// LogSync asks the server for up to n messages sent before the given message,
+// or the most recent messages if before is zero, and waits for the log-reply.
+func (r *Room) LogSync(n int, before snowflake.Snowflake, timeout time.Duration) (*proto.LogReply, error) {
+	raw, err := r.Call(proto.LogType, proto.LogCommand{N: n, Before: before}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := raw.(*proto.LogReply)
+	if !ok {
+		return nil, fmt.Errorf("Could not assert payload as *proto.LogReply")
+	}
+	return reply, nil
+}
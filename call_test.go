@@ -0,0 +1,66 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	. "gopkg.in/check.v1"
+)
+
+type CallSuite struct{}
+
+var _ = Suite(&CallSuite{})
+
+// answer reads the next outgoing packet and sends back a reply with the same
+// ID built from the given payload and error.
+func answer(conn *MockConn, replyType proto.PacketType, payload interface{}, errMsg string) *proto.Packet {
+	msg := <-conn.outgoing
+	reply, _ := MakePacket(replyType, payload)
+	reply.ID = msg.ID
+	reply.Error = errMsg
+	conn.incoming <- reply
+	return msg
+}
+
+func (s *CallSuite) TestSendTextSync(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	go room.Run()
+	go answer(conn, proto.SendReplyType, proto.SendReply{ID: snowflake.Snowflake(42), Content: "hi"}, "")
+	reply, err := room.SendTextSync(nil, "hi", time.Second)
+	c.Assert(err, IsNil)
+	c.Check(reply.ID, Equals, snowflake.Snowflake(42))
+	c.Check(reply.Content, Equals, "hi")
+}
+
+func (s *CallSuite) TestServerError(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	go room.Run()
+	go answer(conn, proto.NickReplyType, proto.NickReply{}, "nick too long")
+	_, err = room.NickSync("a very long nick", time.Second)
+	serverErr, ok := err.(*ServerError)
+	c.Assert(ok, Equals, true)
+	c.Check(serverErr.Message, Equals, "nick too long")
+	time.Sleep(50 * time.Millisecond)
+	c.Check(room.Ctx.Alive(), Equals, true)
+}
+
+func (s *CallSuite) TestTimeout(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	go room.Run()
+	go func() { <-conn.outgoing }()
+	_, err = room.WhoSync(50 * time.Millisecond)
+	c.Check(err, Equals, ErrCallTimeout)
+	room.msgMu.Lock()
+	c.Check(len(room.pending), Equals, 0)
+	room.msgMu.Unlock()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockTimeout is how long the db commands wait for the database lock, which a
+// running bot holds.
+const lockTimeout = time.Second
+
+func dbCmd(cfgPath string, args []string) error {
+	if len(args) == 0 {
+		return errUsage("a subcommand is required")
+	}
+	switch args[0] {
+	case "dump":
+		return dumpCmd(cfgPath, args[1:])
+	case "restore":
+		return restoreCmd(cfgPath, args[1:])
+	default:
+		return errUsage(fmt.Sprintf("unknown subcommand %q", args[0]))
+	}
+}
+
+// openDB opens a bolt database, failing instead of waiting if it is in use.
+func openDB(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Database %s is in use, stop the bot first", path)
+	}
+	return db, err
+}
+
+// dumpCmd writes a consistent copy of the bot's database to a file or to
+// standard output.
+func dumpCmd(cfgPath string, args []string) error {
+	fs := newFlagSet("db dump")
+	out := fs.String("o", "", "write the copy to `file` instead of standard output")
+	if err := noArgs(fs, args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.Bot.DbPath); err != nil {
+		return err
+	}
+	db, err := openDB(cfg.Bot.DbPath, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// restoreCmd replaces the bot's database with a copy made by dumpCmd. The copy
+// is checked and written next to the database before it replaces it, so that
+// a failed restore leaves the database as it was.
+func restoreCmd(cfgPath string, args []string) error {
+	fs := newFlagSet("db restore")
+	force := fs.Bool("force", false, "replace the database if it already exists")
+	if err := fs.Parse(args); err != nil {
+		return errUsage(err.Error())
+	}
+	if fs.NArg() != 1 {
+		return errUsage("exactly one file to restore is required")
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	dbPath := cfg.Bot.DbPath
+	if _, err := os.Stat(dbPath); err == nil {
+		if !*force {
+			return fmt.Errorf("Database %s already exists, use -force to replace it", dbPath)
+		}
+		// Make sure the bot is not running before replacing its database.
+		db, err := openDB(dbPath, false)
+		if err != nil {
+			return err
+		}
+		db.Close()
+	}
+
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		return err
+	}
+	src, err := openDB(fs.Arg(0), true)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", fs.Arg(0), err)
+	}
+	defer src.Close()
+	tmp := filepath.Join(filepath.Dir(dbPath), "."+filepath.Base(dbPath)+".restore")
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmp, 0600)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Restored %s from %s.\n", dbPath, fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,320 @@
+// Command gobot runs and manages bots described by a gobot configuration file
+// (see package config), so that a bot can be deployed without writing a main
+// package for it.
+//
+// Usage:
+//
+//	gobot [-config file] <command> [arguments]
+//
+// The commands are:
+//
+//	run [-watch interval]      run the bot until interrupted or its rooms fail
+//	validate                   check the configuration file
+//	rooms                      list the configured rooms
+//	send [-parent id] room msg post a message to a room and exit
+//	db dump [-o file]          write a copy of the bot's database
+//	db restore [-force] file   replace the bot's database with a copy
+//
+// While running, the bot reloads the configuration file when it receives
+// SIGHUP or when the file changes, joining and leaving rooms as needed; see
+// config.Reloader.
+//
+// gobot exits with status 0 on success, 1 on failure and 2 on invalid usage.
+// In particular, run exits with status 1 if it stops because no room is left
+// running and at least one of them failed; see gobot.Bot.RunAllRooms.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/Sirupsen/logrus"
+	"github.com/cpalone/gobot"
+	"github.com/cpalone/gobot/config"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// watchInterval is how often run checks the configuration file for changes by
+// default.
+const watchInterval = 2 * time.Second
+
+// connectTimeout limits how long send waits for the room to connect.
+const connectTimeout = 30 * time.Second
+
+// errUsage is returned by commands whose arguments are invalid.
+type errUsage string
+
+func (e errUsage) Error() string {
+	return string(e)
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(cfgPath string, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run [-watch interval]", runCmd},
+		{"validate", "validate", validateCmd},
+		{"rooms", "rooms", roomsCmd},
+		{"send", "send [-parent id] <room> <message>", sendCmd},
+		{"db", "db dump [-o file] | db restore [-force] <file>", dbCmd},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gobot [-config file] <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  gobot %s\n", cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	cfgPath := flag.String("config", "gobot.yml", "path to the bot's configuration `file`")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(*cfgPath, flag.Args()[1:])
+		switch err.(type) {
+		case nil:
+			os.Exit(exitOK)
+		case errUsage:
+			fmt.Fprintf(os.Stderr, "gobot %s: %s\nUsage: gobot %s\n", name, err, cmd.usage)
+			os.Exit(exitUsage)
+		default:
+			fmt.Fprintf(os.Stderr, "gobot %s: %s\n", name, err)
+			os.Exit(exitError)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "gobot: unknown command %q\n\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
+
+// loadConfig loads and validates the configuration file.
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// noArgs parses the flags of a command that takes no arguments.
+func noArgs(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage(err.Error())
+	}
+	if fs.NArg() > 0 {
+		return errUsage(fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+	return nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+// interrupted returns a channel that receives SIGINT and SIGTERM.
+func interrupted() chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+func runCmd(cfgPath string, args []string) error {
+	fs := newFlagSet("run")
+	watch := fs.Duration("watch", watchInterval, "how often to check the configuration file for changes, or 0 to only reload on SIGHUP")
+	if err := noArgs(fs, args); err != nil {
+		return err
+	}
+	rl, err := config.NewReloader(cfgPath)
+	if err != nil {
+		return err
+	}
+	b := rl.Bot
+	sig := interrupted()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var runErr error
+	done := make(chan struct{})
+	go func() {
+		runErr = b.RunAllRooms()
+		close(done)
+	}()
+	if *watch > 0 {
+		go rl.Watch(*watch, done)
+	}
+	for {
+		select {
+		case <-hup:
+			b.Logger.Infof("Received SIGHUP, reloading %s...", cfgPath)
+			if err := rl.Reload(); err != nil {
+				b.Logger.Errorf("Error reloading %s: %s", cfgPath, err)
+			}
+		case s := <-sig:
+			b.Logger.Warningf("Received %s, stopping...", s)
+			b.Stop()
+			<-done
+			return nil
+		case <-done:
+			// Every room has stopped, either deliberately or because
+			// it failed, in which case runErr says so.
+			b.Stop()
+			return runErr
+		}
+	}
+}
+
+func validateCmd(cfgPath string, args []string) error {
+	if err := noArgs(newFlagSet("validate"), args); err != nil {
+		return err
+	}
+	if _, err := loadConfig(cfgPath); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid.\n", cfgPath)
+	return nil
+}
+
+func roomsCmd(cfgPath string, args []string) error {
+	if err := noArgs(newFlagSet("rooms"), args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOM\tSERVER\tARCHIVE\tRESTART")
+	for _, room := range cfg.Rooms {
+		server := room.Server.URL
+		if server == "" {
+			server = cfg.Bot.Server.URL
+		}
+		if server == "" {
+			server = gobot.DefaultServerURL
+		}
+		restart := room.Restart
+		if restart == "" {
+			restart = gobot.RestartNever
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", room.RoomName, server, room.Archive, restart)
+	}
+	return w.Flush()
+}
+
+// sendCmd connects to a single room with the configured identity, posts a
+// message and exits. It uses a temporary database so that it can run while
+// the bot itself is running.
+func sendCmd(cfgPath string, args []string) error {
+	fs := newFlagSet("send")
+	parentID := fs.String("parent", "", "ID of the message to reply to")
+	if err := fs.Parse(args); err != nil {
+		return errUsage(err.Error())
+	}
+	if fs.NArg() < 2 {
+		return errUsage("a room and a message are required")
+	}
+	roomName, text := fs.Arg(0), strings.Join(fs.Args()[1:], " ")
+	var parent *snowflake.Snowflake
+	if *parentID != "" {
+		id, err := snowflake.ParseSnowflake(*parentID)
+		if err != nil {
+			return errUsage(fmt.Sprintf("invalid parent %q: %s", *parentID, err))
+		}
+		parent = &id
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+	roomCfg := gobot.RoomConfig{RoomName: roomName}
+	for _, room := range cfg.Rooms {
+		if room.RoomName == roomName {
+			roomCfg = room
+		}
+	}
+	roomCfg.Archive = false
+	roomCfg.Search = false
+	roomCfg.Transcript = ""
+	roomCfg.Conn = &gobot.WSConnection{}
+
+	dir, err := ioutil.TempDir("", "gobot-send")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	botCfg := cfg.Bot
+	botCfg.DbPath = filepath.Join(dir, "send.db")
+	botCfg.Metrics = ""
+	botCfg.Admin = gobot.AdminConfig{}
+	b, err := gobot.NewBot(botCfg)
+	if err != nil {
+		return err
+	}
+	defer b.Stop()
+	b.Logger.Level = logrus.WarnLevel
+	b.AddRoom(roomCfg)
+	room, _ := b.Room(roomName)
+	room.Logger.Level = logrus.WarnLevel
+	failed := make(chan error, 1)
+	go func() {
+		failed <- room.Run()
+	}()
+
+	sig := interrupted()
+	timeout := time.After(connectTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for room.State() != gobot.RoomConnected {
+		select {
+		case err := <-failed:
+			return fmt.Errorf("Could not connect to room %s: %s", roomName, err)
+		case <-timeout:
+			return fmt.Errorf("Timed out connecting to room %s", roomName)
+		case s := <-sig:
+			return fmt.Errorf("Interrupted by %s", s)
+		case <-ticker.C:
+		}
+	}
+	reply, err := room.SendTextSync(parent, text, gobot.DefaultCallTimeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent message %s.\n", reply.ID)
+	return nil
+}
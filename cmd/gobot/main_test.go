@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CommandSuite struct {
+	dir string
+	cfg string
+}
+
+var _ = Suite(&CommandSuite{})
+
+func (s *CommandSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "gobot-cmd")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.cfg = filepath.Join(dir, "gobot.yml")
+	s.write(c, "  - RoomName: test\n")
+}
+
+func (s *CommandSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *CommandSuite) write(c *C, rooms string) {
+	data := "Bot:\n  Name: TestBot\n  DbPath: " + filepath.Join(s.dir, "test.db") + "\nRooms:\n" + rooms
+	c.Assert(ioutil.WriteFile(s.cfg, []byte(data), 0600), IsNil)
+}
+
+func (s *CommandSuite) TestUsage(c *C) {
+	for _, t := range []struct {
+		run  func(string, []string) error
+		args []string
+	}{
+		{runCmd, []string{"extra"}},
+		{runCmd, []string{"-watch", "often"}},
+		{validateCmd, []string{"extra"}},
+		{roomsCmd, []string{"-x"}},
+		{sendCmd, []string{"test"}},
+		{sendCmd, []string{"-parent", "!", "test", "hi"}},
+		{dbCmd, nil},
+		{dbCmd, []string{"compact"}},
+		{dbCmd, []string{"restore"}},
+	} {
+		err := t.run(s.cfg, t.args)
+		_, ok := err.(errUsage)
+		c.Check(ok, Equals, true, Commentf("%v: %v", t.args, err))
+	}
+}
+
+func (s *CommandSuite) TestValidate(c *C) {
+	c.Check(validateCmd(s.cfg, nil), IsNil)
+	s.write(c, "  - RoomName: test\n  - RoomName: test\n")
+	c.Check(validateCmd(s.cfg, nil), ErrorMatches, ".*gobot.yml: Room test is configured twice")
+	s.write(c, "  - RoomName: test\n    Search: true\n")
+	c.Check(validateCmd(s.cfg, nil), ErrorMatches, ".*gobot.yml: Room test: Search requires Archive")
+	c.Check(validateCmd(filepath.Join(s.dir, "missing.yml"), nil), NotNil)
+}
+
+func (s *CommandSuite) TestRunInvalidConfig(c *C) {
+	s.write(c, "  - RoomName: \"\"\n")
+	err := runCmd(s.cfg, nil)
+	c.Check(err, ErrorMatches, `.*Rooms\[0\]\.RoomName is not set`)
+	_, ok := err.(errUsage)
+	c.Check(ok, Equals, false)
+}
+
+func (s *CommandSuite) TestRestoreNeedsForce(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "test.db"), nil, 0600), IsNil)
+	err := dbCmd(s.cfg, []string{"restore", filepath.Join(s.dir, "copy.db")})
+	c.Check(err, ErrorMatches, ".*already exists, use -force to replace it")
+}
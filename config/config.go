@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"gopkg.in/yaml.v2"
@@ -17,7 +18,9 @@ type Config struct {
 	LongHelp          string             `yaml:"LongHelp"`
 }
 
-func configFromFile(path string) (*Config, error) {
+// Load reads a YAML configuration file. It does not validate the
+// configuration; see Validate.
+func Load(path string) (*Config, error) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -29,34 +32,97 @@ func configFromFile(path string) (*Config, error) {
 	return c, nil
 }
 
-func botFromConfig(c *Config) (*gobot.Bot, error) {
+// Validate checks the configuration for mistakes that would keep the bot from
+// starting or connecting, without connecting to anything.
+func (c *Config) Validate() error {
+	if c.Bot.Name == "" {
+		return fmt.Errorf("Bot.Name is not set")
+	}
+	if c.Bot.DbPath == "" {
+		return fmt.Errorf("Bot.DbPath is not set")
+	}
+	if err := c.Bot.Server.Validate(); err != nil {
+		return fmt.Errorf("Bot.Server: %s", err)
+	}
+	if c.Bot.Admin.Addr != "" && c.Bot.Admin.Token == "" {
+		return fmt.Errorf("Bot.Admin.Token is required with Bot.Admin.Addr")
+	}
+	seen := make(map[string]bool)
+	for i, room := range c.Rooms {
+		if room.RoomName == "" {
+			return fmt.Errorf("Rooms[%d].RoomName is not set", i)
+		}
+		if seen[room.RoomName] {
+			return fmt.Errorf("Room %s is configured twice", room.RoomName)
+		}
+		seen[room.RoomName] = true
+		if err := room.Server.Validate(); err != nil {
+			return fmt.Errorf("Room %s: Server: %s", room.RoomName, err)
+		}
+		if room.Search && !room.Archive {
+			return fmt.Errorf("Room %s: Search requires Archive", room.RoomName)
+		}
+	}
+	return nil
+}
+
+// BotFromConfig creates a bot with the configured rooms and, if
+// FollowBotProtocol is set, the bot protocol handlers.
+func BotFromConfig(c *Config) (*gobot.Bot, error) {
+	return newBot(c, c.helpHandler())
+}
+
+// newBot creates a bot with the configured rooms, which share the given help
+// handler.
+func newBot(c *Config, help *handlers.HelpHandler) (*gobot.Bot, error) {
 	b, err := gobot.NewBot(c.Bot)
 	if err != nil {
 		return nil, err
 	}
 	if c.FollowBotProtocol {
 		b.Logger.Debugln("Adding handlers for bot protocol...")
-		for i, _ := range c.Rooms {
-			c.Rooms[i].AddlHandlers = []gobot.Handler{
-				&handlers.PongHandler{},
-				&handlers.UptimeHandler{},
-				&handlers.HelpHandler{LongDesc: c.LongHelp,
-					ShortDesc: c.ShortHelp}}
-		}
 	}
-	for _, roomCfg := range c.Rooms {
-		roomCfg.Conn = &gobot.WSConnection{}
-		b.AddRoom(roomCfg)
+	for _, room := range c.Rooms {
+		b.AddRoom(c.roomConfig(room, help))
 	}
 	return b, nil
 }
 
+func (c *Config) helpHandler() *handlers.HelpHandler {
+	return &handlers.HelpHandler{ShortDesc: c.ShortHelp, LongDesc: c.LongHelp}
+}
+
+// roomConfig returns room with its connection and the handlers implied by the
+// configuration added, leaving c unchanged.
+func (c *Config) roomConfig(room gobot.RoomConfig, help *handlers.HelpHandler) gobot.RoomConfig {
+	room.AddlHandlers = append([]gobot.Handler(nil), room.AddlHandlers...)
+	if c.FollowBotProtocol {
+		room.AddlHandlers = append(room.AddlHandlers,
+			&handlers.PongHandler{},
+			&handlers.UptimeHandler{},
+			help,
+			&handlers.KillHandler{},
+			&handlers.PauseHandler{})
+	}
+	if room.Search {
+		room.AddlHandlers = append(room.AddlHandlers, &handlers.SearchHandler{})
+	}
+	room.Conn = &gobot.WSConnection{}
+	return room
+}
+
+// BotFromCfgFile loads and validates a configuration file and creates a bot
+// from it. Use NewReloader instead to apply later changes to the file to the
+// running bot.
 func BotFromCfgFile(path string) (*gobot.Bot, error) {
-	cfg, err := configFromFile(path)
+	cfg, err := Load(path)
 	if err != nil {
 		return nil, err
 	}
-	b, err := botFromConfig(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := BotFromConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpalone/gobot"
+	"github.com/cpalone/gobot/handlers"
+)
+
+// Reloader runs a bot from a configuration file and applies later changes to
+// the file to the running bot, without dropping the connections of rooms that
+// are unaffected:
+//
+//   - rooms added to the file are joined, and rooms removed from it are left;
+//   - rooms whose configuration changed are left and joined again, losing any
+//     handlers that were added to them after they were created;
+//   - changes to ShortHelp and LongHelp are applied in place;
+//   - changes to FollowBotProtocol rejoin every room.
+//
+// Changes to the Bot section, such as the bot's name or database, take effect
+// only when the bot is restarted.
+type Reloader struct {
+	Bot *gobot.Bot
+
+	path string
+	help *handlers.HelpHandler
+
+	mu    sync.Mutex
+	cfg   *Config
+	stamp fileStamp
+}
+
+// fileStamp identifies a version of a file, for noticing when it changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// NewReloader loads and validates a configuration file and creates a bot from
+// it, like BotFromCfgFile. Call Reload or Watch once the bot is running to
+// apply changes to the file.
+func NewReloader(path string) (*Reloader, error) {
+	stamp, err := statFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadValid(path)
+	if err != nil {
+		return nil, err
+	}
+	rl := &Reloader{path: path, help: cfg.helpHandler(), cfg: cfg, stamp: stamp}
+	rl.Bot, err = newBot(cfg, rl.help)
+	if err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+func loadValid(path string) (*Config, error) {
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// Reload reads the configuration file again and applies the differences from
+// the running configuration to the bot. If the file cannot be loaded or is
+// invalid, the bot is left as it was. RunAllRooms must be running.
+//
+// Reload applies the changes through the bot's control commands, so like
+// gobot.Bot.JoinRoom it must not be called from a handler.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// Stat the file before reading it, so that a write that races with the
+	// read is noticed by Watch.
+	stamp, err := statFile(rl.path)
+	if err != nil {
+		return err
+	}
+	rl.stamp = stamp
+	cfg, err := loadValid(rl.path)
+	if err != nil {
+		return err
+	}
+	return rl.apply(cfg)
+}
+
+// apply brings the bot from the running configuration to cfg.
+func (rl *Reloader) apply(cfg *Config) error {
+	b, old := rl.Bot, rl.cfg
+	if !reflect.DeepEqual(old.Bot, cfg.Bot) {
+		b.Logger.Warningf("Changes to the Bot section of %s take effect after a restart", rl.path)
+		cfg.Bot = old.Bot
+	}
+	rl.cfg = cfg
+	if cfg.ShortHelp != old.ShortHelp || cfg.LongHelp != old.LongHelp {
+		b.Logger.Infoln("Updating help text...")
+		rl.help.SetHelp(cfg.ShortHelp, cfg.LongHelp)
+	}
+
+	prev := make(map[string]gobot.RoomConfig, len(old.Rooms))
+	for _, room := range old.Rooms {
+		prev[room.RoomName] = room
+	}
+	current := make(map[string]bool, len(cfg.Rooms))
+	for _, room := range cfg.Rooms {
+		current[room.RoomName] = true
+	}
+
+	var errs []string
+	for _, room := range old.Rooms {
+		if current[room.RoomName] {
+			continue
+		}
+		b.Logger.Infof("Leaving room %s...", room.RoomName)
+		if err := b.LeaveRoom(room.RoomName); err != nil {
+			errs = append(errs, fmt.Sprintf("leaving room %s: %s", room.RoomName, err))
+		}
+	}
+	for _, room := range cfg.Rooms {
+		p, ok := prev[room.RoomName]
+		switch {
+		case !ok:
+			b.Logger.Infof("Joining room %s...", room.RoomName)
+			if err := b.JoinRoom(cfg.roomConfig(room, rl.help)); err != nil {
+				errs = append(errs, fmt.Sprintf("joining room %s: %s", room.RoomName, err))
+			}
+		case !reflect.DeepEqual(p, room) || cfg.FollowBotProtocol != old.FollowBotProtocol:
+			b.Logger.Infof("Rejoining room %s with its new configuration...", room.RoomName)
+			if err := b.LeaveRoom(room.RoomName); err != nil {
+				b.Logger.Warningf("Error leaving room %s: %s", room.RoomName, err)
+			}
+			if err := b.JoinRoom(cfg.roomConfig(room, rl.help)); err != nil {
+				errs = append(errs, fmt.Sprintf("rejoining room %s: %s", room.RoomName, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Could not apply all changes: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// changed reports whether the configuration file has changed since it was
+// last loaded.
+func (rl *Reloader) changed() bool {
+	stamp, err := statFile(rl.path)
+	if err != nil {
+		// Editors may remove the file briefly while saving it.
+		rl.Bot.Logger.Debugf("Error checking %s for changes: %s", rl.path, err)
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return stamp != rl.stamp
+}
+
+// Watch checks the configuration file every interval and reloads it when it
+// changes, until stop is closed. Errors are logged rather than returned, and
+// an invalid file is not retried until it changes again.
+func (rl *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !rl.changed() {
+			continue
+		}
+		rl.Bot.Logger.Infof("%s changed, reloading...", rl.path)
+		if err := rl.Reload(); err != nil {
+			rl.Bot.Logger.Errorf("Error reloading %s: %s", rl.path, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/cpalone/gobot"
+	"github.com/cpalone/gobot/heimtest"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ReloadSuite struct {
+	srv *heimtest.Server
+	dir string
+	rl  *Reloader
+}
+
+var _ = Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) SetUpTest(c *C) {
+	s.srv = heimtest.NewServer()
+	dir, err := ioutil.TempDir("", "gobot-config")
+	c.Assert(err, IsNil)
+	s.dir = dir
+}
+
+func (s *ReloadSuite) TearDownTest(c *C) {
+	if s.rl != nil {
+		s.rl.Bot.Stop()
+		s.rl = nil
+	}
+	s.srv.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *ReloadSuite) config(rooms ...string) *Config {
+	cfg := &Config{
+		Bot: gobot.BotConfig{
+			Name:   "TestBot",
+			DbPath: filepath.Join(s.dir, "test.db"),
+			Server: gobot.ServerConfig{URL: s.srv.URL},
+		},
+		FollowBotProtocol: true,
+		ShortHelp:         "short",
+		LongHelp:          "long",
+	}
+	for _, name := range rooms {
+		cfg.Rooms = append(cfg.Rooms, gobot.RoomConfig{RoomName: name})
+	}
+	return cfg
+}
+
+// start runs a bot from cfg, as NewReloader would from a file, and waits for
+// its rooms to connect.
+func (s *ReloadSuite) start(c *C, cfg *Config) {
+	s.rl = &Reloader{path: "test.yml", help: cfg.helpHandler(), cfg: cfg}
+	var err error
+	s.rl.Bot, err = newBot(cfg, s.rl.help)
+	c.Assert(err, IsNil)
+	go s.rl.Bot.RunAllRooms()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, cfg := range cfg.Rooms {
+		room, _ := s.rl.Bot.Room(cfg.RoomName)
+		for room.State() != gobot.RoomConnected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(room.State(), Equals, gobot.RoomConnected)
+	}
+}
+
+// session waits for the bot to have a single session in the named room other
+// than not, and returns its ID, or "" if it does not.
+func (s *ReloadSuite) session(name, not string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sessions := s.srv.Room(name).Sessions()
+		if len(sessions) == 1 && sessions[0].SessionID != not {
+			return sessions[0].SessionID
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ""
+}
+
+// waitLeft waits until the bot has left the named room.
+func (s *ReloadSuite) waitLeft(name string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.srv.Room(name).Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (s *ReloadSuite) TestApply(c *C) {
+	for i, t := range []struct {
+		name     string
+		change   func(cfg *Config)
+		kept     []string
+		rejoined []string
+		joined   []string
+		left     []string
+		help     string
+	}{
+		{
+			name:   "add a room",
+			change: func(cfg *Config) { cfg.Rooms = append(cfg.Rooms, gobot.RoomConfig{RoomName: "c"}) },
+			kept:   []string{"a", "b"},
+			joined: []string{"c"},
+			help:   "short",
+		},
+		{
+			name:   "remove a room",
+			change: func(cfg *Config) { cfg.Rooms = cfg.Rooms[:1] },
+			kept:   []string{"a"},
+			left:   []string{"b"},
+			help:   "short",
+		},
+		{
+			name:     "change a room",
+			change:   func(cfg *Config) { cfg.Rooms[1].HistorySize = 10 },
+			kept:     []string{"a"},
+			rejoined: []string{"b"},
+			help:     "short",
+		},
+		{
+			name:   "change the help",
+			change: func(cfg *Config) { cfg.ShortHelp = "new short" },
+			kept:   []string{"a", "b"},
+			help:   "new short",
+		},
+		{
+			name:   "change the Bot section",
+			change: func(cfg *Config) { cfg.Bot.Name = "OtherBot" },
+			kept:   []string{"a", "b"},
+			help:   "short",
+		},
+		{
+			name:     "toggle the bot protocol",
+			change:   func(cfg *Config) { cfg.FollowBotProtocol = false },
+			rejoined: []string{"a", "b"},
+		},
+	} {
+		c.Log(t.name)
+		if i > 0 {
+			s.TearDownTest(c)
+			s.SetUpTest(c)
+		}
+		s.start(c, s.config("a", "b"))
+		rooms := make(map[string]*gobot.Room)
+		sessions := make(map[string]string)
+		for _, name := range []string{"a", "b"} {
+			rooms[name], _ = s.rl.Bot.Room(name)
+			sessions[name] = s.session(name, "")
+		}
+
+		cfg := s.config("a", "b")
+		t.change(cfg)
+		c.Assert(s.rl.apply(cfg), IsNil, Commentf(t.name))
+		c.Check(s.rl.cfg.Bot.Name, Equals, "TestBot", Commentf(t.name))
+
+		for _, name := range t.kept {
+			room, ok := s.rl.Bot.Room(name)
+			c.Check(ok, Equals, true, Commentf("%s: %s", t.name, name))
+			c.Check(room, Equals, rooms[name], Commentf("%s: %s", t.name, name))
+			c.Check(room.State(), Equals, gobot.RoomConnected, Commentf("%s: %s", t.name, name))
+			c.Check(s.session(name, ""), Equals, sessions[name], Commentf("%s: %s", t.name, name))
+		}
+		for _, name := range t.rejoined {
+			room, ok := s.rl.Bot.Room(name)
+			c.Check(ok, Equals, true, Commentf("%s: %s", t.name, name))
+			c.Check(room, Not(Equals), rooms[name], Commentf("%s: %s", t.name, name))
+			c.Check(s.session(name, sessions[name]), Not(Equals), "", Commentf("%s: %s", t.name, name))
+		}
+		for _, name := range t.joined {
+			_, ok := s.rl.Bot.Room(name)
+			c.Check(ok, Equals, true, Commentf("%s: %s", t.name, name))
+			c.Check(s.session(name, ""), Not(Equals), "", Commentf("%s: %s", t.name, name))
+		}
+		for _, name := range t.left {
+			_, ok := s.rl.Bot.Room(name)
+			c.Check(ok, Equals, false, Commentf("%s: %s", t.name, name))
+			c.Check(s.waitLeft(name), Equals, true, Commentf("%s: %s", t.name, name))
+		}
+
+		user := s.srv.Room("a").Join("user")
+		if t.help != "" {
+			reply, err := user.SendAndWait("!help", 5*time.Second)
+			c.Check(err, IsNil, Commentf(t.name))
+			c.Check(reply.Content, Equals, t.help, Commentf(t.name))
+		} else {
+			_, err := user.SendAndWait("!help", 200*time.Millisecond)
+			c.Check(err, NotNil, Commentf(t.name))
+		}
+	}
+}
+
+func (s *ReloadSuite) TestReload(c *C) {
+	path := filepath.Join(s.dir, "test.yml")
+	write := func(rooms string) {
+		data := "Bot:\n  Name: TestBot\n  DbPath: " + filepath.Join(s.dir, "test.db") +
+			"\n  Server:\n    URL: " + s.srv.URL + "\nRooms:\n" + rooms
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0600), IsNil)
+	}
+	write("  - RoomName: a\n")
+	rl, err := NewReloader(path)
+	c.Assert(err, IsNil)
+	s.rl = rl
+	go rl.Bot.RunAllRooms()
+	c.Assert(s.srv.Room("a").WaitForSessions(1, 5*time.Second), IsNil)
+
+	write("  - RoomName: a\n  - RoomName: b\n")
+	c.Check(rl.Reload(), IsNil)
+	c.Check(s.session("b", ""), Not(Equals), "")
+
+	// An invalid file leaves the bot as it was.
+	write("  - RoomName: a\n  - RoomName: a\n")
+	c.Check(rl.Reload(), ErrorMatches, ".*Room a is configured twice")
+	c.Check(rl.cfg.Rooms, HasLen, 2)
+	_, ok := rl.Bot.Room("b")
+	c.Check(ok, Equals, true)
+}
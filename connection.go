@@ -2,8 +2,7 @@ package gobot
 
 import (
 	"fmt"
-	"strconv"
-	"time"
+	"sync"
 
 	"euphoria.io/heim/proto"
 	"github.com/gorilla/websocket"
@@ -19,25 +18,51 @@ type Connection interface {
 }
 
 // WSConnection is a type that satisfies the Connection interface and manages
-// a websocket connection to a euphoria room.
+// a websocket connection to a euphoria room. The room's send and receive loops
+// may both reconnect, so the current connection is guarded by mu and
+// connecting is serialized by connectMu.
 type WSConnection struct {
-	conn *websocket.Conn
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	connectMu sync.Mutex
+}
+
+func (ws *WSConnection) current() *websocket.Conn {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.conn
 }
 
 func (ws *WSConnection) connectOnce(r *Room, try int) error {
 	r.Logger.Infof("Connecting to room %s...", r.RoomName)
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 5 * time.Second,
+	dialer, err := r.server.dialer()
+	if err != nil {
+		return err
+	}
+	url, err := r.server.roomURL(r.RoomName)
+	if err != nil {
+		return err
 	}
-	url := fmt.Sprintf("wss://euphoria.io/room/%s/ws", r.RoomName)
 	if err := r.Ctx.Check("connectOnce", try); err != nil {
 		return err
 	}
-	wsConn, _, err := dialer.Dial(url, nil)
+	wsConn, _, err := dialer.Dial(url, r.server.header())
 	if err != nil {
 		return err
 	}
+	// The room may have been stopped while dialing, in which case its
+	// connection has already been closed and this one would never be.
+	ws.mu.Lock()
+	if !r.Ctx.Alive() {
+		ws.mu.Unlock()
+		wsConn.Close()
+		return fmt.Errorf("Room %s is stopped", r.RoomName)
+	}
+	if ws.conn != nil {
+		ws.conn.Close()
+	}
 	ws.conn = wsConn
+	ws.mu.Unlock()
 	if r.password != "" {
 		if _, err := r.sendAuth(); err != nil {
 			return err
@@ -49,8 +74,27 @@ func (ws *WSConnection) connectOnce(r *Room, try int) error {
 	return nil
 }
 
-// Connect tries to connect to a euphoria room with multiple retries upon error.
+// Connect tries to connect to a euphoria room, retrying upon error as directed
+// by the room's ReconnectPolicy. It returns as soon as the room's context is
+// finished, even while waiting to retry. Any previous connection is closed.
 func (ws *WSConnection) Connect(r *Room) error {
+	ws.connectMu.Lock()
+	defer ws.connectMu.Unlock()
+	return ws.connect(r)
+}
+
+// reconnect replaces failed, the connection on which an error was seen, or
+// nil if there was none, unless it has already been replaced meanwhile.
+func (ws *WSConnection) reconnect(r *Room, failed *websocket.Conn) error {
+	ws.connectMu.Lock()
+	defer ws.connectMu.Unlock()
+	if ws.current() != failed {
+		return nil
+	}
+	return ws.connect(r)
+}
+
+func (ws *WSConnection) connect(r *Room) error {
 	if err := r.Ctx.Check("Connect"); err != nil {
 		return err
 	}
@@ -59,13 +103,20 @@ func (ws *WSConnection) Connect(r *Room) error {
 		return nil
 	}
 	r.Logger.Warningf("Error connecting on first try: %s", err)
-	for count := 1; count < MAXRETRIES; count++ {
-		err = ws.connectOnce(r, count)
+	for retry := 1; ; retry++ {
+		delay, ok := r.reconnect.Delay(retry)
+		if !ok {
+			break
+		}
+		r.Logger.Infof("Retrying connection in %s...", delay)
+		if err := sleepContext(r.Ctx, delay); err != nil {
+			return err
+		}
+		err = ws.connectOnce(r, retry)
 		if err == nil {
 			return nil
 		}
-		r.Logger.Warningf("Error connecting on retry #%s: %s", err)
-		time.Sleep(time.Duration(count) * time.Second * 5)
+		r.Logger.Warningf("Error connecting on retry #%d: %s", retry, err)
 	}
 	r.Logger.Errorf("Error connecting to websocket: %s", err)
 	return err
@@ -76,39 +127,57 @@ func (ws *WSConnection) SendJSON(r *Room, msg interface{}) (string, error) {
 	if err := r.Ctx.Check("SendJSON"); err != nil {
 		return "", err
 	}
-	if ws.conn == nil {
-		if err := ws.Connect(r); err != nil {
+	if ws.current() == nil {
+		if err := ws.reconnect(r, nil); err != nil {
 			return "", err
 		}
 	}
-	if err := ws.conn.WriteJSON(msg); err != nil {
-		err = ws.Connect(r)
+	if conn := ws.current(); conn.WriteJSON(msg) != nil {
+		r.metrics.reconnected(r.RoomName)
+		r.setState(RoomConnecting)
+		err := ws.reconnect(r, conn)
 		if err != nil {
 			return "", err
 		}
-		if err := ws.conn.WriteJSON(msg); err != nil {
+		r.setState(RoomConnected)
+		if err := ws.current().WriteJSON(msg); err != nil {
 			r.Logger.Warningf("Error writing JSON: %s", err)
 			return "", err
 		}
 	}
-	return strconv.Itoa(r.msgID), nil
+	if p, ok := msg.(*proto.Packet); ok {
+		return p.ID, nil
+	}
+	return "", nil
 }
 
 // ReceiveJSON reads a message from the websocket and unmarshals it into the
-// provided packet.
+// provided packet. If the connection cannot be restored, the room's context is
+// terminated, so that its RestartPolicy applies.
 func (ws *WSConnection) ReceiveJSON(r *Room, p chan *proto.Packet) {
-	if ws.conn == nil {
-		if err := ws.Connect(r); err != nil {
-			r.Logger.Errorf("Error connecting to euphoria: %s", err)
+	if ws.current() == nil {
+		if err := ws.reconnect(r, nil); err != nil {
+			r.Logger.Errorf("Error connecting to euphoria, terminating room: %s", err)
+			r.Ctx.Terminate(err)
 			return
 		}
 	}
 	var msg proto.Packet
-	if err := ws.conn.ReadJSON(&msg); err != nil {
+	conn := ws.current()
+	if err := conn.ReadJSON(&msg); err != nil {
+		if !r.Ctx.Alive() {
+			// The room was stopped and closed the connection.
+			return
+		}
 		r.Logger.Warningf("Error reading JSON, reconnecting: %s", err)
-		if err := ws.Connect(r); err != nil {
-			r.Logger.Errorf("Error reconnecting: %s", err)
+		r.metrics.reconnected(r.RoomName)
+		r.setState(RoomConnecting)
+		if err := ws.reconnect(r, conn); err != nil {
+			r.Logger.Errorf("Error reconnecting, terminating room: %s", err)
+			r.Ctx.Terminate(err)
+			return
 		}
+		r.setState(RoomConnected)
 		if r.Ctx.Alive() {
 			p <- nil
 		}
@@ -121,8 +190,9 @@ func (ws *WSConnection) ReceiveJSON(r *Room, p chan *proto.Packet) {
 
 // Close simply closes the websocket connection, if it is connected.
 func (ws *WSConnection) Close() error {
-	if ws.conn == nil {
+	conn := ws.current()
+	if conn == nil {
 		return nil
 	}
-	return ws.conn.Close()
+	return conn.Close()
 }
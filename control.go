@@ -0,0 +1,194 @@
+package gobot
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// JoinRoomCmd asks a running Bot to add a room with the given configuration
+// and start it. The result is sent on Reply.
+type JoinRoomCmd struct {
+	Config RoomConfig
+	Reply  chan error
+}
+
+// LeaveRoomCmd asks a running Bot to stop the named room and remove it. The
+// result is sent on Reply.
+type LeaveRoomCmd struct {
+	RoomName string
+	Reply    chan error
+}
+
+// RestartRoomCmd asks a running Bot to stop the named room and start it again
+// with a fresh context and connection. The result is sent on Reply.
+type RestartRoomCmd struct {
+	RoomName string
+	Reply    chan error
+}
+
+// ListRoomsCmd asks a running Bot for the names of its rooms, which are sent
+// on Reply in sorted order.
+type ListRoomsCmd struct {
+	Reply chan []string
+}
+
+// controlLoop serves commands sent on the bot's cmd channel until the bot's
+// context is finished.
+func (b *Bot) controlLoop() {
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.Logger.Debugln("controlLoop exiting...")
+			return
+		case cmd := <-b.cmd:
+			b.handleCmd(cmd)
+		}
+	}
+}
+
+func (b *Bot) handleCmd(cmd interface{}) {
+	switch c := cmd.(type) {
+	case *JoinRoomCmd:
+		c.Reply <- b.joinRoom(c.Config)
+	case *LeaveRoomCmd:
+		c.Reply <- b.RemoveRoom(c.RoomName)
+	case *RestartRoomCmd:
+		c.Reply <- b.restartRoom(c.RoomName)
+	case *ListRoomsCmd:
+		c.Reply <- b.roomNames()
+	default:
+		b.Logger.Errorf("Unknown control command of type %T", cmd)
+	}
+}
+
+func (b *Bot) joinRoom(cfg RoomConfig) error {
+	if _, ok := b.Room(cfg.RoomName); ok {
+		return fmt.Errorf("Already in room: %s", cfg.RoomName)
+	}
+	b.AddRoom(cfg)
+	room, _ := b.Room(cfg.RoomName)
+	b.runRoom(room)
+	return nil
+}
+
+func (b *Bot) restartRoom(roomName string) error {
+	old, ok := b.Room(roomName)
+	if !ok {
+		return fmt.Errorf("No such room: %s", roomName)
+	}
+	b.roomsMu.RLock()
+	sup, ok := b.supervisors[roomName]
+	b.roomsMu.RUnlock()
+	if ok && sup.restart() {
+		return nil
+	}
+	// The room is not supervised, or its supervisor has given up on it, so
+	// start it again under a new supervisor.
+	if err := old.Stop(); err != nil {
+		b.Logger.Warningf("Error stopping room %s for restart: %s", roomName, err)
+	}
+	room := b.newRoom(old.cfg)
+	room.Handlers = old.Handlers
+	room.carryPause(old)
+	b.roomsMu.Lock()
+	b.Rooms[roomName] = room
+	b.roomsMu.Unlock()
+	b.runRoom(room)
+	return nil
+}
+
+// serving reports whether RunAllRooms is serving control commands.
+func (b *Bot) serving() bool {
+	return atomic.LoadInt32(&b.running) == 1
+}
+
+// supervised reports whether the named room has a supervisor that is running
+// it or waiting to restart it.
+func (b *Bot) supervised(roomName string) bool {
+	b.roomsMu.RLock()
+	defer b.roomsMu.RUnlock()
+	sup, ok := b.supervisors[roomName]
+	return ok && !sup.finished
+}
+
+// haltRoom stops the named room's supervisor and with it the room, which may
+// be running or waiting to be restarted. Unlike RemoveRoom, the room stays
+// registered with the bot, so that it can be started again with RestartRoom.
+func (b *Bot) haltRoom(roomName string) error {
+	b.roomsMu.RLock()
+	sup, ok := b.supervisors[roomName]
+	b.roomsMu.RUnlock()
+	if !ok || !sup.halt() {
+		return fmt.Errorf("Room %s is not running", roomName)
+	}
+	return nil
+}
+
+func (b *Bot) roomNames() []string {
+	b.roomsMu.RLock()
+	defer b.roomsMu.RUnlock()
+	names := make([]string, 0, len(b.Rooms))
+	for name := range b.Rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// send delivers a control command to the running bot. It fails if the bot is
+// stopped before the command is accepted.
+func (b *Bot) send(cmd interface{}) error {
+	select {
+	case b.cmd <- cmd:
+		return nil
+	case <-b.ctx.Done():
+		return fmt.Errorf("Bot is stopped: %s", b.ctx.Err())
+	}
+}
+
+// JoinRoom adds a room to a running bot and starts it. RunAllRooms must be
+// running for the command to be served.
+//
+// JoinRoom and the other control commands wait for the bot's control loop,
+// which in turn waits for the rooms it stops to finish their handlers. They
+// must therefore not be called from a Handler's HandleIncoming, event or Stop
+// methods, which would deadlock; handlers should call them from a goroutine of
+// their own instead.
+func (b *Bot) JoinRoom(cfg RoomConfig) error {
+	cmd := &JoinRoomCmd{Config: cfg, Reply: make(chan error, 1)}
+	if err := b.send(cmd); err != nil {
+		return err
+	}
+	return <-cmd.Reply
+}
+
+// LeaveRoom stops a room on a running bot and removes it. The other rooms are
+// not affected. Like JoinRoom, it must not be called from a handler.
+func (b *Bot) LeaveRoom(roomName string) error {
+	cmd := &LeaveRoomCmd{RoomName: roomName, Reply: make(chan error, 1)}
+	if err := b.send(cmd); err != nil {
+		return err
+	}
+	return <-cmd.Reply
+}
+
+// RestartRoom stops a room on a running bot and starts it again with a new
+// context. The room keeps its configuration and handlers. Like JoinRoom, it
+// must not be called from a handler.
+func (b *Bot) RestartRoom(roomName string) error {
+	cmd := &RestartRoomCmd{RoomName: roomName, Reply: make(chan error, 1)}
+	if err := b.send(cmd); err != nil {
+		return err
+	}
+	return <-cmd.Reply
+}
+
+// ListRooms returns the names of the rooms on a running bot in sorted order.
+func (b *Bot) ListRooms() ([]string, error) {
+	cmd := &ListRoomsCmd{Reply: make(chan []string, 1)}
+	if err := b.send(cmd); err != nil {
+		return nil, err
+	}
+	return <-cmd.Reply, nil
+}
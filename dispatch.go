@@ -0,0 +1,336 @@
+package gobot
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"euphoria.io/heim/proto"
+)
+
+const (
+	// DefaultHandlerTimeout is the deadline for a call to HandleIncoming when
+	// neither the handler nor the room sets one.
+	DefaultHandlerTimeout = 10 * time.Second
+
+	// DefaultHandlerQueueSize is the number of packets that may wait for a
+	// handler when neither the handler nor the room sets a queue size.
+	DefaultHandlerQueueSize = 64
+
+	// DefaultHandlerWorkers is the number of calls to a handler that may be in
+	// flight at once when neither the handler nor the room sets a limit.
+	DefaultHandlerWorkers = 1
+)
+
+// DispatchOptions controls how packets are passed to a Handler. Each handler
+// has its own queue and its calls never hold up other handlers or ping replies.
+//
+// Calls to HandleIncoming start in the order packets were received. The next
+// call waits for the previous one to return, unless the previous call misses
+// its Timeout; the late call is then reported and left running while the next
+// one starts, up to Workers calls at once. A packet that arrives while the
+// handler's queue of QueueSize packets is full is dropped for that handler.
+//
+// With the default of one worker, a handler sees packets strictly in order,
+// and a call that misses its deadline holds up the handler's queue until it
+// returns. More workers let the handler keep up past a slow call, at the cost
+// of that order: a packet may then be handled before an earlier one whose call
+// is still running, so such handlers must not depend on the order of packets.
+//
+// ErrorPolicy decides what happens when the handler returns an error or panics
+// in HandleIncoming or Run; see ErrorPolicy for the choices and MaxFailures.
+type DispatchOptions struct {
+	Timeout     time.Duration `yaml:"Timeout,omitempty"`
+	QueueSize   int           `yaml:"QueueSize,omitempty"`
+	Workers     int           `yaml:"Workers,omitempty"`
+	ErrorPolicy ErrorPolicy   `yaml:"ErrorPolicy,omitempty"`
+	MaxFailures int           `yaml:"MaxFailures,omitempty"`
+}
+
+// HandlerOptions may be implemented by a Handler to override the room's
+// DispatchOptions for that handler. Zero fields are left as the room's.
+type HandlerOptions interface {
+	DispatchOptions() DispatchOptions
+}
+
+// merge returns o with its zero fields taken from defaults.
+func (o DispatchOptions) merge(defaults DispatchOptions) DispatchOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = defaults.Timeout
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaults.QueueSize
+	}
+	if o.Workers <= 0 {
+		o.Workers = defaults.Workers
+	}
+	if o.ErrorPolicy == "" {
+		o.ErrorPolicy = defaults.ErrorPolicy
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = defaults.MaxFailures
+	}
+	return o
+}
+
+var defaultDispatchOptions = DispatchOptions{
+	Timeout:     DefaultHandlerTimeout,
+	QueueSize:   DefaultHandlerQueueSize,
+	Workers:     DefaultHandlerWorkers,
+	ErrorPolicy: ErrorTerminate,
+	MaxFailures: DefaultMaxFailures,
+}
+
+// handlerWorker feeds packets to a single handler from its own queue.
+type handlerWorker struct {
+	room    *Room
+	handler Handler
+	opts    DispatchOptions
+	queue   chan *Event
+	slots   chan struct{}
+
+	mu       sync.Mutex
+	handled  uint64
+	dropped  uint64
+	timedOut uint64
+	errors   uint64
+	failures int
+	disabled bool
+	lastErr  error
+}
+
+func newHandlerWorker(r *Room, handler Handler) *handlerWorker {
+	opts := r.cfg.Dispatch.merge(defaultDispatchOptions)
+	if ho, ok := handler.(HandlerOptions); ok {
+		opts = ho.DispatchOptions().merge(opts)
+	}
+	return &handlerWorker{
+		room:    r.handlerRoom(handler),
+		handler: handler,
+		opts:    opts,
+		queue:   make(chan *Event, opts.QueueSize),
+		slots:   make(chan struct{}, opts.Workers),
+	}
+}
+
+// enqueue adds an event to the handler's queue without blocking and reports
+// whether there was room for it.
+func (w *handlerWorker) enqueue(ev *Event) bool {
+	if w.isDisabled() {
+		return true
+	}
+	select {
+	case w.queue <- ev:
+		return true
+	default:
+		w.mu.Lock()
+		w.dropped++
+		w.mu.Unlock()
+		w.room.metrics.dropped(w.room.RoomName, w.handler)
+		return false
+	}
+}
+
+// run calls the handler for each queued packet until the room's context is
+// finished.
+func (w *handlerWorker) run() {
+	defer w.room.Ctx.WaitGroup().Done()
+	for {
+		select {
+		case <-w.room.Ctx.Done():
+			return
+		case ev := <-w.queue:
+			if w.isDisabled() {
+				continue
+			}
+			if !w.call(ev) {
+				return
+			}
+		}
+	}
+}
+
+// call runs the handler in its own goroutine and waits for it to return or for
+// its deadline to pass. It returns false if the room's context finished.
+func (w *handlerWorker) call(ev *Event) bool {
+	select {
+	case w.slots <- struct{}{}:
+	case <-w.room.Ctx.Done():
+		return false
+	}
+	done := make(chan struct{})
+	go func() {
+		defer func() { <-w.slots }()
+		defer close(done)
+		start := time.Now()
+		err := w.handle(ev)
+		w.room.metrics.handled(w.room.RoomName, w.handler, time.Since(start), err)
+		if err != nil {
+			w.fail(err)
+		} else {
+			w.succeed()
+		}
+	}()
+	timer := time.NewTimer(w.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		w.mu.Lock()
+		w.timedOut++
+		w.mu.Unlock()
+		w.room.Logger.Warningf("Handler %s missed its %s deadline for a %s packet",
+			handlerName(w.handler), w.opts.Timeout, ev.Type())
+	case <-w.room.Ctx.Done():
+		return false
+	}
+	return true
+}
+
+// handle passes the event to the handler's HandleEvent method, or else to
+// HandleIncoming as a copy of the packet, queueing any packet it returns. It
+// then calls the matching typed event method.
+func (w *handlerWorker) handle(ev *Event) error {
+	if err := w.handleIncoming(ev); err != nil {
+		return err
+	}
+	return w.handleEvent(ev)
+}
+
+func (w *handlerWorker) handleIncoming(ev *Event) (err error) {
+	var retPacket *proto.Packet
+	if eh, ok := w.handler.(EventHandler); ok {
+		defer recoverHandler(w.handler, "HandleEvent", &err)
+		retPacket, err = eh.HandleEvent(w.room, ev)
+	} else {
+		defer recoverHandler(w.handler, "HandleIncoming", &err)
+		p := ev.Packet()
+		retPacket, err = w.handler.HandleIncoming(w.room, &p)
+	}
+	if err != nil {
+		return err
+	}
+	if retPacket != nil && w.room.pausable && w.room.Paused() {
+		w.room.Logger.Debugf("Room is paused, dropping %s packet from handler %s",
+			retPacket.Type, handlerName(w.handler))
+		return nil
+	}
+	if retPacket != nil {
+		atomic.AddInt64(&w.room.queued, 1)
+		select {
+		case w.room.outbound <- retPacket:
+		case <-w.room.Ctx.Done():
+			atomic.AddInt64(&w.room.queued, -1)
+		}
+	}
+	return nil
+}
+
+func (w *handlerWorker) handleEvent(ev *Event) (err error) {
+	defer recoverHandler(w.handler, eventMethods[ev.Type()], &err)
+	return callEvent(w.room, w.handler, ev)
+}
+
+// runHandler calls the handler's Run method and applies the error policy if
+// it panics.
+func (w *handlerWorker) runHandler() {
+	if err := safeRun(w.room, w.handler); err != nil {
+		w.fail(err)
+	}
+}
+
+func (w *handlerWorker) succeed() {
+	w.mu.Lock()
+	w.handled++
+	w.failures = 0
+	w.mu.Unlock()
+}
+
+// fail records an error from the handler and applies its ErrorPolicy.
+func (w *handlerWorker) fail(err error) {
+	w.mu.Lock()
+	w.errors++
+	w.failures++
+	w.lastErr = err
+	failures := w.failures
+	w.mu.Unlock()
+
+	name := handlerName(w.handler)
+	switch w.opts.ErrorPolicy {
+	case ErrorLog:
+		w.room.Logger.Errorf("Error in handler %s: %s", name, err)
+	case ErrorDisable:
+		w.room.Logger.Errorf("Error in handler %s (%d/%d): %s", name, failures, w.opts.MaxFailures, err)
+		if failures >= w.opts.MaxFailures {
+			w.room.Logger.Errorf("Disabling handler %s after %d failures", name, failures)
+			w.mu.Lock()
+			w.disabled = true
+			w.mu.Unlock()
+		}
+	default:
+		w.room.Logger.Errorf("Error in handler %s, shutting down room: %s", name, err)
+		w.room.Ctx.Terminate(err)
+	}
+}
+
+func (w *handlerWorker) isDisabled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.disabled
+}
+
+func (w *handlerWorker) status() HandlerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := HandlerStatus{
+		Name:     handlerName(w.handler),
+		Handled:  w.handled,
+		Dropped:  w.dropped,
+		TimedOut: w.timedOut,
+		Errors:   w.errors,
+		Disabled: w.disabled,
+	}
+	if w.lastErr != nil {
+		status.LastError = w.lastErr.Error()
+	}
+	return status
+}
+
+// handlerName identifies a handler in logs.
+func handlerName(h Handler) string {
+	return fmt.Sprintf("%T", h)
+}
+
+// startWorkers creates a worker for each of the room's handlers, starts it,
+// and calls the handler's Run method.
+func (r *Room) startWorkers() {
+	workers := make([]*handlerWorker, 0, len(r.Handlers))
+	for _, handler := range r.Handlers {
+		w := newHandlerWorker(r, handler)
+		workers = append(workers, w)
+		r.Ctx.WaitGroup().Add(1)
+		go w.run()
+		go w.runHandler()
+	}
+	r.workersMu.Lock()
+	r.workers = workers
+	r.workersMu.Unlock()
+}
+
+// dispatch hands an event to every handler's queue, skipping handlers that
+// are suspended while the room is paused.
+func (r *Room) dispatch(ev *Event) {
+	paused := r.Paused()
+	r.workersMu.RLock()
+	defer r.workersMu.RUnlock()
+	for _, w := range r.workers {
+		if paused && w.room.pausable {
+			continue
+		}
+		if !w.enqueue(ev) {
+			r.Logger.Warningf("Queue for handler %s is full, dropping %s packet",
+				handlerName(w.handler), ev.Type())
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package gobot
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+// funcHandler calls fn for every send-event it receives.
+type funcHandler struct {
+	fn   func(msg *proto.SendEvent)
+	opts DispatchOptions
+}
+
+func (h *funcHandler) HandleIncoming(r *Room, p *proto.Packet) (*proto.Packet, error) {
+	if p.Type != proto.SendEventType {
+		return nil, nil
+	}
+	raw, err := p.Payload()
+	if err != nil {
+		return nil, err
+	}
+	h.fn(raw.(*proto.SendEvent))
+	return nil, nil
+}
+
+func (h *funcHandler) Run(r *Room)  {}
+func (h *funcHandler) Stop(r *Room) {}
+
+func (h *funcHandler) DispatchOptions() DispatchOptions { return h.opts }
+
+func sendEvent(content string) *proto.Packet {
+	p, _ := MakePacket(proto.SendEventType, proto.SendEvent{Content: content})
+	return p
+}
+
+type DispatchSuite struct{}
+
+var _ = Suite(&DispatchSuite{})
+
+func (s *DispatchSuite) TestSlowHandlerDoesNotBlock(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	release := make(chan struct{})
+	defer close(release)
+	slow := &funcHandler{
+		fn:   func(*proto.SendEvent) { <-release },
+		opts: DispatchOptions{Timeout: 20 * time.Millisecond},
+	}
+	seen := make(chan string, 10)
+	fast := &funcHandler{fn: func(msg *proto.SendEvent) { seen <- msg.Content }}
+	room.Handlers = []Handler{slow, fast}
+	go room.Run()
+
+	conn.incoming <- sendEvent("one")
+	conn.incoming <- sendEvent("two")
+	for _, want := range []string{"one", "two"} {
+		select {
+		case got := <-seen:
+			c.Check(got, Equals, want)
+		case <-time.After(time.Second):
+			c.Fatal("fast handler was blocked by slow handler")
+		}
+	}
+
+	ping, _ := MakePacket(proto.PingEventType, proto.PingEvent{UnixTime: proto.Time(time.Now())})
+	conn.incoming <- ping
+	select {
+	case msg := <-conn.outgoing:
+		c.Check(msg.Type, Equals, proto.PingReplyType)
+	case <-time.After(time.Second):
+		c.Fatal("ping reply was blocked by slow handler")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	c.Check(room.HandlerStatus()[0].TimedOut > 0, Equals, true)
+}
+
+func (s *DispatchSuite) TestOrdering(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	var mu sync.Mutex
+	var got []string
+	done := make(chan struct{})
+	h := &funcHandler{fn: func(msg *proto.SendEvent) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		got = append(got, msg.Content)
+		if len(got) == 20 {
+			close(done)
+		}
+		mu.Unlock()
+	}}
+	room.Handlers = []Handler{h}
+	go room.Run()
+	var want []string
+	for i := 0; i < 20; i++ {
+		content := fmt.Sprintf("%d", i)
+		want = append(want, content)
+		conn.incoming <- sendEvent(content)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		c.Fatal("handler did not receive every packet")
+	}
+	mu.Lock()
+	c.Check(got, DeepEquals, want)
+	mu.Unlock()
+}
+
+func (s *DispatchSuite) TestOrderingPastDeadline(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	release := make(chan struct{})
+	seen := make(chan string, 10)
+	h := &funcHandler{
+		fn: func(msg *proto.SendEvent) {
+			if msg.Content == "slow" {
+				<-release
+			}
+			seen <- msg.Content
+		},
+		opts: DispatchOptions{Timeout: 20 * time.Millisecond},
+	}
+	room.Handlers = []Handler{h}
+	go room.Run()
+
+	conn.incoming <- sendEvent("slow")
+	conn.incoming <- sendEvent("next")
+	select {
+	case got := <-seen:
+		c.Fatalf("%s was handled before the slow call returned", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for _, want := range []string{"slow", "next"} {
+		select {
+		case got := <-seen:
+			c.Check(got, Equals, want)
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	c.Check(room.HandlerStatus()[0].TimedOut, Equals, uint64(1))
+}
+
+func (s *DispatchSuite) TestOptionsMerge(c *C) {
+	room := &Room{cfg: RoomConfig{Dispatch: DispatchOptions{Timeout: time.Second, Workers: 5}}}
+	w := newHandlerWorker(room, &funcHandler{opts: DispatchOptions{Workers: 1}})
+	c.Check(w.opts.Timeout, Equals, time.Second)
+	c.Check(w.opts.QueueSize, Equals, DefaultHandlerQueueSize)
+	c.Check(w.opts.Workers, Equals, 1)
+}
@@ -8,16 +8,43 @@
 // attached to.
 //
 // A bolt database and a scope.Context are exposed by the room to be used as the
-// user sees fit. The framework itself uses the Context but not the database.
-// Therefore, one should be careful with scope.Context.Waitgroup() - do not Wait
-// unless you are familiar with the internals of the package.
+// user sees fit. The framework itself uses the Context, so one should be
+// careful with scope.Context.Waitgroup() - do not Wait unless you are familiar
+// with the internals of the package.
 //
 // The bolt database provides a persistent key-value store on disk and the
-// scope.Context provides an in-memory key-value store. The framework does not
-// use either of these stores, so the user may use them without fear of
-// collisions.
+// scope.Context provides an in-memory key-value store. The framework keeps its
+// own data in bolt buckets whose names start with "_gobot" and does not use the
+// context's store. Handlers should keep their data in the namespaced stores
+// returned by Bot.Store and Room.Store, which cannot collide with each other
+// and can be backed by NewMemoryStorage in tests. When the layout of that data
+// changes, a handler can register ordered migrations with RegisterMigrations;
+// NewBot applies each of them once.
+//
+// Rooms configured with RoomConfig.Archive record their messages, edits, joins
+// and parts in the framework's own buckets, where handlers can query them with
+// Room.Archive instead of storing message history themselves. Rooms that also
+// set RoomConfig.Search index their archived messages for Archive.Search,
+// which handlers.SearchHandler offers to users as "!search".
+//
+// Setting BotConfig.Metrics serves counters and histograms about packets,
+// handlers, reconnects and ping times in the Prometheus text format; see
+// Bot.MetricsHandler. Setting BotConfig.Admin serves an HTTP API, protected by
+// a token, for listing, starting and stopping rooms and sending messages; see
+// Bot.AdminHandler.
+//
+// Most handlers respond to commands such as "!ping @BotName". A Router parses
+// these commands and calls the function registered for each command name, so
+// that handlers need not match message content themselves.
+//
+// Handlers interested in particular events can embed BaseHandler and implement
+// methods such as OnSend or OnJoin instead of decoding packets themselves; see
+// SendEventHandler and the related interfaces.
 //
 // A small example of a handler is included in the handlers package. It simply
 // replies to a message of "!ping" with "pong!". The program in the sample
 // package uses this to create a simple, functioning bot with the framework.
+//
+// The heimtest package runs a fake heim server in the test process, so that
+// bots can be tested end to end over a real websocket connection.
 package gobot
@@ -0,0 +1,217 @@
+package gobot
+
+import (
+	"fmt"
+	"sync"
+
+	"euphoria.io/heim/proto"
+)
+
+// The following interfaces may be implemented by a Handler to receive decoded
+// events instead of raw packets. The dispatcher detects them and calls the
+// matching method after HandleIncoming, decoding each packet only once for
+// all of the room's handlers. Errors are treated like errors returned from
+// HandleIncoming. Embed BaseHandler to get no-op Handler methods.
+
+// SendEventHandler receives messages posted to the room.
+type SendEventHandler interface {
+	OnSend(r *Room, e *proto.SendEvent) error
+}
+
+// JoinEventHandler is told about sessions joining the room.
+type JoinEventHandler interface {
+	OnJoin(r *Room, e *proto.PresenceEvent) error
+}
+
+// PartEventHandler is told about sessions leaving the room.
+type PartEventHandler interface {
+	OnPart(r *Room, e *proto.PresenceEvent) error
+}
+
+// NickEventHandler is told about sessions changing their nick.
+type NickEventHandler interface {
+	OnNick(r *Room, e *proto.NickEvent) error
+}
+
+// SnapshotEventHandler receives the snapshot sent by the server after the bot
+// joins the room.
+type SnapshotEventHandler interface {
+	OnSnapshot(r *Room, e *proto.SnapshotEvent) error
+}
+
+// EditEventHandler is told about messages being edited or deleted.
+type EditEventHandler interface {
+	OnEdit(r *Room, e *proto.EditMessageEvent) error
+}
+
+// BounceEventHandler is told when the server refuses the bot access to the
+// room.
+type BounceEventHandler interface {
+	OnBounce(r *Room, e *proto.BounceEvent) error
+}
+
+// HelloEventHandler receives the hello-event sent by the server when the bot
+// connects.
+type HelloEventHandler interface {
+	OnHello(r *Room, e *proto.HelloEvent) error
+}
+
+// BaseHandler provides no-op implementations of the Handler methods. Embed it
+// in handlers that only implement the typed event interfaces.
+type BaseHandler struct{}
+
+// HandleIncoming is a no-op.
+func (BaseHandler) HandleIncoming(r *Room, p *proto.Packet) (*proto.Packet, error) {
+	return nil, nil
+}
+
+// Run is a no-op.
+func (BaseHandler) Run(r *Room) {
+	return
+}
+
+// Stop is a no-op.
+func (BaseHandler) Stop(r *Room) {
+	return
+}
+
+// Event is a received packet together with its payload, which is decoded at
+// most once and shared by the dispatcher and all of the room's handlers. It
+// must be treated as read-only: the payload returned by Payload is the same
+// value for every handler.
+type Event struct {
+	packet  *proto.Packet
+	once    sync.Once
+	payload interface{}
+	err     error
+}
+
+func newEvent(p *proto.Packet) *Event {
+	return &Event{packet: p}
+}
+
+// Type returns the type of the packet.
+func (e *Event) Type() proto.PacketType {
+	return e.packet.Type
+}
+
+// Packet returns a copy of the packet. Its Data is shared and must not be
+// modified.
+func (e *Event) Packet() proto.Packet {
+	return *e.packet
+}
+
+// Payload returns the decoded payload of the packet, decoding it on the first
+// call.
+func (e *Event) Payload() (interface{}, error) {
+	e.once.Do(func() {
+		e.payload, e.err = e.packet.Payload()
+	})
+	return e.payload, e.err
+}
+
+// EventHandler may be implemented by a Handler to receive each packet as an
+// Event. The dispatcher then calls HandleEvent instead of HandleIncoming, so
+// that the handler can use the shared payload rather than decoding the packet
+// again.
+type EventHandler interface {
+	HandleEvent(r *Room, e *Event) (*proto.Packet, error)
+}
+
+// eventMethods names the typed event method for each packet type, for use in
+// errors.
+var eventMethods = map[proto.PacketType]string{
+	proto.SendEventType:        "OnSend",
+	proto.JoinEventType:        "OnJoin",
+	proto.PartEventType:        "OnPart",
+	proto.NickEventType:        "OnNick",
+	proto.SnapshotEventType:    "OnSnapshot",
+	proto.EditMessageEventType: "OnEdit",
+	proto.BounceEventType:      "OnBounce",
+	proto.HelloEventType:       "OnHello",
+}
+
+// wantsEvent reports whether h implements the typed event interface for
+// packets of the given type.
+func wantsEvent(h Handler, pType proto.PacketType) bool {
+	var ok bool
+	switch pType {
+	case proto.SendEventType:
+		_, ok = h.(SendEventHandler)
+	case proto.JoinEventType:
+		_, ok = h.(JoinEventHandler)
+	case proto.PartEventType:
+		_, ok = h.(PartEventHandler)
+	case proto.NickEventType:
+		_, ok = h.(NickEventHandler)
+	case proto.SnapshotEventType:
+		_, ok = h.(SnapshotEventHandler)
+	case proto.EditMessageEventType:
+		_, ok = h.(EditEventHandler)
+	case proto.BounceEventType:
+		_, ok = h.(BounceEventHandler)
+	case proto.HelloEventType:
+		_, ok = h.(HelloEventHandler)
+	}
+	return ok
+}
+
+// callEvent decodes the event and calls the typed event method of h that
+// matches its packet type, if h implements it.
+func callEvent(r *Room, h Handler, ev *Event) error {
+	pType := ev.Type()
+	if !wantsEvent(h, pType) {
+		return nil
+	}
+	payload, err := ev.Payload()
+	if err != nil {
+		return err
+	}
+	ok := true
+	switch pType {
+	case proto.SendEventType:
+		var e *proto.SendEvent
+		if e, ok = payload.(*proto.SendEvent); ok {
+			err = h.(SendEventHandler).OnSend(r, e)
+		}
+	case proto.JoinEventType:
+		var e *proto.PresenceEvent
+		if e, ok = payload.(*proto.PresenceEvent); ok {
+			err = h.(JoinEventHandler).OnJoin(r, e)
+		}
+	case proto.PartEventType:
+		var e *proto.PresenceEvent
+		if e, ok = payload.(*proto.PresenceEvent); ok {
+			err = h.(PartEventHandler).OnPart(r, e)
+		}
+	case proto.NickEventType:
+		var e *proto.NickEvent
+		if e, ok = payload.(*proto.NickEvent); ok {
+			err = h.(NickEventHandler).OnNick(r, e)
+		}
+	case proto.SnapshotEventType:
+		var e *proto.SnapshotEvent
+		if e, ok = payload.(*proto.SnapshotEvent); ok {
+			err = h.(SnapshotEventHandler).OnSnapshot(r, e)
+		}
+	case proto.EditMessageEventType:
+		var e *proto.EditMessageEvent
+		if e, ok = payload.(*proto.EditMessageEvent); ok {
+			err = h.(EditEventHandler).OnEdit(r, e)
+		}
+	case proto.BounceEventType:
+		var e *proto.BounceEvent
+		if e, ok = payload.(*proto.BounceEvent); ok {
+			err = h.(BounceEventHandler).OnBounce(r, e)
+		}
+	case proto.HelloEventType:
+		var e *proto.HelloEvent
+		if e, ok = payload.(*proto.HelloEvent); ok {
+			err = h.(HelloEventHandler).OnHello(r, e)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("Could not assert payload of %s packet, got %T", pType, payload)
+	}
+	return err
+}
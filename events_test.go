@@ -0,0 +1,231 @@
+package gobot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+// eventHandler records the typed events it receives.
+type eventHandler struct {
+	BaseHandler
+	events chan string
+	sends  chan *proto.SendEvent
+}
+
+func newEventHandler() *eventHandler {
+	return &eventHandler{
+		events: make(chan string, 10),
+		sends:  make(chan *proto.SendEvent, 10),
+	}
+}
+
+func (h *eventHandler) OnSend(r *Room, e *proto.SendEvent) error {
+	h.sends <- e
+	h.events <- "send " + e.Content
+	return nil
+}
+
+func (h *eventHandler) OnJoin(r *Room, e *proto.PresenceEvent) error {
+	h.events <- "join " + e.Name
+	return nil
+}
+
+func (h *eventHandler) OnPart(r *Room, e *proto.PresenceEvent) error {
+	h.events <- "part " + e.Name
+	return nil
+}
+
+func (h *eventHandler) OnNick(r *Room, e *proto.NickEvent) error {
+	h.events <- "nick " + e.From + " " + e.To
+	return nil
+}
+
+// panicOnSend panics in OnSend.
+type panicOnSend struct {
+	BaseHandler
+}
+
+func (h *panicOnSend) OnSend(r *Room, e *proto.SendEvent) error {
+	panic("boom")
+}
+
+func (h *panicOnSend) DispatchOptions() DispatchOptions {
+	return DispatchOptions{ErrorPolicy: ErrorLog}
+}
+
+type EventSuite struct{}
+
+var _ = Suite(&EventSuite{})
+
+// expectEvent checks that the next event recorded by an eventHandler is want.
+func expectEvent(c *C, events chan string, want string) {
+	select {
+	case got := <-events:
+		c.Check(got, Equals, want)
+	case <-time.After(time.Second):
+		c.Errorf("timed out waiting for %q", want)
+	}
+}
+
+func (s *EventSuite) TestTypedEvents(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	h := newEventHandler()
+	room.Handlers = []Handler{h}
+	go room.Run()
+
+	join, _ := MakePacket(proto.JoinEventType, proto.PresenceEvent{IdentityView: proto.IdentityView{Name: "alice"}})
+	part, _ := MakePacket(proto.PartEventType, proto.PresenceEvent{IdentityView: proto.IdentityView{Name: "bob"}})
+	nick, _ := MakePacket(proto.NickEventType, proto.NickEvent{From: "alice", To: "carol"})
+	for _, p := range []*proto.Packet{join, part, nick, sendEvent("hi")} {
+		conn.incoming <- p
+	}
+	expectEvent(c, h.events, "join alice")
+	expectEvent(c, h.events, "part bob")
+	expectEvent(c, h.events, "nick alice carol")
+	expectEvent(c, h.events, "send hi")
+}
+
+func (s *EventSuite) TestPayloadSharedByHandlers(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	h1, h2 := newEventHandler(), newEventHandler()
+	room.Handlers = []Handler{h1, h2}
+	go room.Run()
+
+	conn.incoming <- sendEvent("hi")
+	var got [2]*proto.SendEvent
+	for i, h := range []*eventHandler{h1, h2} {
+		select {
+		case got[i] = <-h.sends:
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for send-event")
+		}
+	}
+	c.Check(got[0], Equals, got[1])
+}
+
+func (s *EventSuite) TestPanicInEventMethod(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.Handlers = []Handler{&panicOnSend{}}
+	go room.Run()
+
+	conn.incoming <- sendEvent("hi")
+	time.Sleep(50 * time.Millisecond)
+	c.Check(room.Ctx.Alive(), Equals, true)
+	status := room.HandlerStatus()[0]
+	c.Check(status.Errors, Equals, uint64(1))
+	c.Check(strings.Contains(status.LastError, "panic in *gobot.panicOnSend.OnSend: boom"), Equals, true)
+}
+
+// payloadHandler implements EventHandler and records the payloads it sees.
+type payloadHandler struct {
+	BaseHandler
+	payloads chan interface{}
+}
+
+func (h *payloadHandler) HandleEvent(r *Room, e *Event) (*proto.Packet, error) {
+	payload, err := e.Payload()
+	if err != nil {
+		return nil, err
+	}
+	h.payloads <- payload
+	return nil, nil
+}
+
+func (s *EventSuite) TestEventHandler(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	h1 := &payloadHandler{payloads: make(chan interface{}, 1)}
+	h2 := newEventHandler()
+	room.Handlers = []Handler{h1, h2}
+	go room.Run()
+
+	conn.incoming <- sendEvent("hi")
+	var payload interface{}
+	var msg *proto.SendEvent
+	select {
+	case payload = <-h1.payloads:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for HandleEvent")
+	}
+	select {
+	case msg = <-h2.sends:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for OnSend")
+	}
+	c.Check(payload, Equals, interface{}(msg))
+}
+
+const benchHandlers = 10
+
+// decodingHandler decodes every packet itself, as handlers did before Event.
+type decodingHandler struct {
+	BaseHandler
+}
+
+func (h *decodingHandler) HandleIncoming(r *Room, p *proto.Packet) (*proto.Packet, error) {
+	_, err := p.Payload()
+	return nil, err
+}
+
+// sharingHandler uses the payload shared by the dispatcher.
+type sharingHandler struct {
+	BaseHandler
+}
+
+func (h *sharingHandler) OnSend(r *Room, e *proto.SendEvent) error {
+	return nil
+}
+
+func benchmarkDispatch(b *testing.B, h Handler) {
+	room := &Room{}
+	workers := make([]*handlerWorker, benchHandlers)
+	for i := range workers {
+		workers[i] = &handlerWorker{room: room, handler: h}
+	}
+	p, err := MakePacket(proto.SendEventType, proto.SendEvent{
+		ID:      1000,
+		Parent:  999,
+		Content: "!ping @GoBot and some more text to make the message realistic",
+		Sender:  proto.SessionView{IdentityView: proto.IdentityView{Name: "someone"}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ev := newEvent(p)
+		for _, w := range workers {
+			if err := w.handle(ev); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkDispatchDecodePerHandler measures a send-event passed to handlers
+// that each decode it in HandleIncoming.
+func BenchmarkDispatchDecodePerHandler(b *testing.B) {
+	benchmarkDispatch(b, &decodingHandler{})
+}
+
+// BenchmarkDispatchSharedPayload measures a send-event passed to handlers that
+// use the payload decoded once by the dispatcher.
+func BenchmarkDispatchSharedPayload(b *testing.B) {
+	benchmarkDispatch(b, &sharingHandler{})
+}
@@ -0,0 +1,99 @@
+package gobot
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrorPolicy decides what happens when a handler returns an error or panics.
+type ErrorPolicy string
+
+const (
+	// ErrorTerminate terminates the room with the handler's error. This is the
+	// default.
+	ErrorTerminate ErrorPolicy = "terminate"
+
+	// ErrorLog logs the error and keeps passing packets to the handler.
+	ErrorLog ErrorPolicy = "log"
+
+	// ErrorDisable logs the error and stops passing packets to the handler
+	// once it has failed MaxFailures times in a row.
+	ErrorDisable ErrorPolicy = "disable"
+)
+
+// DefaultMaxFailures is the number of consecutive failures after which the
+// ErrorDisable policy disables a handler, if MaxFailures is not set.
+const DefaultMaxFailures = 3
+
+// PanicError is the error a panic in one of a handler's methods is turned
+// into. Stack holds the stack trace of the panicking goroutine.
+type PanicError struct {
+	Handler string
+	Method  string
+	Value   interface{}
+	Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s.%s: %v\n%s", e.Handler, e.Method, e.Value, e.Stack)
+}
+
+// recoverHandler turns a panic in the named handler method into a *PanicError
+// stored in err. It must be deferred directly.
+func recoverHandler(h Handler, method string, err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{
+			Handler: handlerName(h),
+			Method:  method,
+			Value:   v,
+			Stack:   debug.Stack(),
+		}
+	}
+}
+
+// HandlerStatus describes the state of one of a room's handlers.
+type HandlerStatus struct {
+	Name      string
+	Handled   uint64
+	Dropped   uint64
+	TimedOut  uint64
+	Errors    uint64
+	Disabled  bool
+	LastError string
+}
+
+// HandlerStatus returns the status of each of the room's handlers, in the
+// order they were added. It is empty until the room is run.
+func (r *Room) HandlerStatus() []HandlerStatus {
+	r.workersMu.RLock()
+	defer r.workersMu.RUnlock()
+	status := make([]HandlerStatus, 0, len(r.workers))
+	for _, w := range r.workers {
+		status = append(status, w.status())
+	}
+	return status
+}
+
+// callHandlerStop calls Stop on each of the room's handlers once, recovering
+// from and logging any panics.
+func (r *Room) callHandlerStop() {
+	r.stopHandlers.Do(func() {
+		for _, handler := range r.Handlers {
+			if err := safeStop(r.handlerRoom(handler), handler); err != nil {
+				r.Logger.Errorf("Error stopping handler: %s", err)
+			}
+		}
+	})
+}
+
+func safeStop(r *Room, handler Handler) (err error) {
+	defer recoverHandler(handler, "Stop", &err)
+	handler.Stop(r)
+	return nil
+}
+
+func safeRun(r *Room, handler Handler) (err error) {
+	defer recoverHandler(handler, "Run", &err)
+	handler.Run(r)
+	return nil
+}
@@ -0,0 +1,111 @@
+package gobot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+// faultyHandler fails on every send-event, either by panicking or by
+// returning an error.
+type faultyHandler struct {
+	panics     bool
+	panicOnRun bool
+	stopped    chan struct{}
+	opts       DispatchOptions
+}
+
+func (h *faultyHandler) HandleIncoming(r *Room, p *proto.Packet) (*proto.Packet, error) {
+	if p.Type != proto.SendEventType {
+		return nil, nil
+	}
+	if h.panics {
+		panic("boom")
+	}
+	return nil, fmt.Errorf("failed")
+}
+
+func (h *faultyHandler) Run(r *Room) {
+	if h.panicOnRun {
+		panic("boom in Run")
+	}
+}
+
+func (h *faultyHandler) Stop(r *Room) {
+	if h.stopped != nil {
+		close(h.stopped)
+	}
+	panic("boom in Stop")
+}
+
+func (h *faultyHandler) DispatchOptions() DispatchOptions { return h.opts }
+
+type FaultSuite struct{}
+
+var _ = Suite(&FaultSuite{})
+
+func (s *FaultSuite) runFaulty(c *C, h *faultyHandler, packets int) (*Bot, *Room) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	room, _ := b.Room("test")
+	room.Handlers = []Handler{h}
+	go room.Run()
+	for i := 0; i < packets; i++ {
+		select {
+		case conn.incoming <- sendEvent("hi"):
+		case <-time.After(time.Second):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return b, room
+}
+
+func (s *FaultSuite) TestPanicLogged(c *C) {
+	b, room := s.runFaulty(c, &faultyHandler{panics: true, opts: DispatchOptions{ErrorPolicy: ErrorLog}}, 2)
+	defer b.Stop()
+	c.Check(room.Ctx.Alive(), Equals, true)
+	status := room.HandlerStatus()[0]
+	c.Check(status.Errors, Equals, uint64(2))
+	c.Check(status.Disabled, Equals, false)
+	c.Check(strings.Contains(status.LastError, "panic in *gobot.faultyHandler.HandleIncoming: boom"), Equals, true)
+	c.Check(strings.Contains(status.LastError, "goroutine"), Equals, true)
+}
+
+func (s *FaultSuite) TestCircuitBreaker(c *C) {
+	h := &faultyHandler{opts: DispatchOptions{ErrorPolicy: ErrorDisable, MaxFailures: 2}}
+	b, room := s.runFaulty(c, h, 4)
+	defer b.Stop()
+	c.Check(room.Ctx.Alive(), Equals, true)
+	status := room.HandlerStatus()[0]
+	c.Check(status.Errors, Equals, uint64(2))
+	c.Check(status.Disabled, Equals, true)
+}
+
+func (s *FaultSuite) TestTerminateByDefault(c *C) {
+	b, room := s.runFaulty(c, &faultyHandler{}, 1)
+	defer b.Stop()
+	c.Check(room.Ctx.Alive(), Equals, false)
+}
+
+func (s *FaultSuite) TestPanicInRun(c *C) {
+	b, room := s.runFaulty(c, &faultyHandler{panicOnRun: true}, 0)
+	defer b.Stop()
+	c.Check(room.Ctx.Alive(), Equals, false)
+	_, ok := room.Ctx.Err().(*PanicError)
+	c.Check(ok, Equals, true)
+}
+
+func (s *FaultSuite) TestPanicInStop(c *C) {
+	h := &faultyHandler{stopped: make(chan struct{})}
+	b, room := s.runFaulty(c, h, 0)
+	defer b.Stop()
+	c.Check(room.Stop(), IsNil)
+	select {
+	case <-h.stopped:
+	default:
+		c.Fatal("handler's Stop was not called")
+	}
+}
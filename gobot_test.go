@@ -3,8 +3,8 @@ package gobot
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -27,9 +27,8 @@ func (c *MockConn) SendJSON(r *Room, msg interface{}) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("Could not assert message as packet.")
 	}
-	p.ID = strconv.Itoa(r.msgID)
 	c.outgoing <- p
-	return strconv.Itoa(r.msgID), nil
+	return p.ID, nil
 }
 
 func (c *MockConn) ReceiveJSON(r *Room, p chan *proto.Packet) {
@@ -336,3 +335,270 @@ func (s *BotSuite) TestSendBadConnect(c *C) {
 	time.Sleep(time.Second)
 	c.Check(b.Rooms["test"].Ctx.Alive(), Equals, false)
 }
+
+func (s *BotSuite) TestJoinLeaveRoom(c *C) {
+	b, _, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	conn := &MockConn{
+		outgoing: make(chan *proto.Packet),
+		incoming: make(chan *proto.Packet),
+	}
+	err = b.JoinRoom(RoomConfig{RoomName: "other", Conn: conn})
+	c.Check(err, IsNil)
+	c.Check(b.JoinRoom(RoomConfig{RoomName: "other", Conn: conn}), NotNil)
+	names, err := b.ListRooms()
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"other", "test"})
+
+	other, ok := b.Room("other")
+	c.Check(ok, Equals, true)
+	c.Check(b.LeaveRoom("other"), IsNil)
+	c.Check(other.Ctx.Alive(), Equals, false)
+	_, ok = b.Room("other")
+	c.Check(ok, Equals, false)
+	c.Check(b.LeaveRoom("other"), NotNil)
+
+	room, _ := b.Room("test")
+	c.Check(room.Ctx.Alive(), Equals, true)
+}
+
+func (s *BotSuite) TestRestartRoom(c *C) {
+	b, _, err := MockBotWithPong()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	old, _ := b.Room("test")
+	c.Check(b.RestartRoom("test"), IsNil)
+	room, _ := b.Room("test")
+	c.Check(room, Not(Equals), old)
+	c.Check(old.Ctx.Alive(), Equals, false)
+	c.Check(room.Ctx.Alive(), Equals, true)
+	c.Check(len(room.Handlers), Equals, 1)
+	c.Check(b.RestartRoom("nope"), NotNil)
+}
+
+func MockBotWithRestart(policy RestartPolicy) (*Bot, *MockConn, error) {
+	b, err := NewBot(BotConfig{Name: "test", DbPath: "test.db"})
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := &MockConn{
+		outgoing: make(chan *proto.Packet),
+		incoming: make(chan *proto.Packet),
+	}
+	b.AddRoom(RoomConfig{
+		RoomName:       "test",
+		Restart:        policy,
+		MaxRestarts:    2,
+		RestartBackoff: 10 * time.Millisecond,
+		Conn:           conn,
+	})
+	return b, conn, nil
+}
+
+func disconnectPacket() *proto.Packet {
+	p, _ := MakePacket(proto.DisconnectEventType, proto.DisconnectEvent{Reason: "test"})
+	return p
+}
+
+type SupervisorSuite struct{}
+
+var _ = Suite(&SupervisorSuite{})
+
+func (s *SupervisorSuite) TestRestartOnFailure(c *C) {
+	b, conn, err := MockBotWithRestart(RestartOnFailure)
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	old, _ := b.Room("test")
+	conn.incoming <- disconnectPacket()
+	time.Sleep(200 * time.Millisecond)
+	c.Check(old.Ctx.Alive(), Equals, false)
+	room, _ := b.Room("test")
+	c.Check(room, Not(Equals), old)
+	c.Check(room.Ctx.Alive(), Equals, true)
+}
+
+func (s *SupervisorSuite) TestMaxRestarts(c *C) {
+	b, conn, err := MockBotWithRestart(RestartAlways)
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	for i := 0; i < 3; i++ {
+		conn.incoming <- disconnectPacket()
+		time.Sleep(100 * time.Millisecond)
+	}
+	room, _ := b.Room("test")
+	c.Check(room.Ctx.Alive(), Equals, false)
+}
+
+func (s *SupervisorSuite) TestNoRestartAfterStop(c *C) {
+	b, _, err := MockBotWithRestart(RestartAlways)
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	time.Sleep(50 * time.Millisecond)
+	old, _ := b.Room("test")
+	c.Check(old.Stop(), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	room, _ := b.Room("test")
+	c.Check(room, Equals, old)
+}
+
+func (s *SupervisorSuite) TestRestartDuringBackoff(c *C) {
+	b, conn, err := MockBotWithRestart(RestartAlways)
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.cfg.RestartBackoff = time.Hour
+	room.cfg.MaxRestarts = 0
+	go b.RunAllRooms()
+	for i := 0; i < 10; i++ {
+		old := room
+		conn.incoming <- disconnectPacket()
+		time.Sleep(50 * time.Millisecond)
+		c.Check(old.Ctx.Alive(), Equals, false)
+		c.Assert(b.RestartRoom("test"), IsNil)
+		time.Sleep(20 * time.Millisecond)
+		room, _ = b.Room("test")
+		c.Assert(room, Not(Equals), old)
+		c.Assert(room.Ctx.Alive(), Equals, true)
+		c.Assert(room.stopRequested(), Equals, false)
+	}
+}
+
+func (s *SupervisorSuite) TestStopWhileRestarting(c *C) {
+	for i := 0; i < 20; i++ {
+		b, conn, err := MockBotWithRestart(RestartAlways)
+		c.Assert(err, IsNil)
+		room, _ := b.Room("test")
+		room.cfg.RestartBackoff = time.Millisecond
+		room.cfg.MaxRestarts = 0
+		go b.RunAllRooms()
+		waitFor(c, func() bool { return room.State() == RoomConnected })
+		conn.incoming <- disconnectPacket()
+		stopped := make(chan struct{})
+		go func() {
+			b.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			c.Fatal("Stop did not return while the room was being restarted")
+		}
+		for _, room := range b.rooms() {
+			c.Check(room.Ctx.Alive(), Equals, false)
+		}
+	}
+}
+
+// closeErrConn is a MockConn whose connection has already dropped.
+type closeErrConn struct {
+	*MockConn
+}
+
+func (c closeErrConn) Close() error {
+	return fmt.Errorf("use of closed network connection")
+}
+
+// stopHandler counts the calls to its Stop method.
+type stopHandler struct {
+	BaseHandler
+	stops int32
+}
+
+func (h *stopHandler) Stop(r *Room) {
+	atomic.AddInt32(&h.stops, 1)
+}
+
+func (s *SupervisorSuite) TestShutdownOnce(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.conn = closeErrConn{conn}
+	h := &stopHandler{}
+	room.Handlers = []Handler{h}
+	go room.Run()
+	waitFor(c, func() bool { return room.State() == RoomConnected })
+
+	c.Check(room.Stop(), ErrorMatches, "use of closed network connection")
+	c.Check(atomic.LoadInt32(&h.stops), Equals, int32(1))
+	// A second Stop, as the supervisor makes, neither fails nor stops the
+	// handler again.
+	c.Check(room.Stop(), IsNil)
+	c.Check(atomic.LoadInt32(&h.stops), Equals, int32(1))
+}
+
+func (s *SupervisorSuite) TestRunAllRoomsReturnsOnFailure(c *C) {
+	b, conn, err := MockBotWithRestart(RestartNever)
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	result := make(chan error, 1)
+	go func() {
+		result <- b.RunAllRooms()
+	}()
+	conn.incoming <- disconnectPacket()
+	select {
+	case err := <-result:
+		c.Check(err, ErrorMatches, "No rooms left running: .*test.*")
+	case <-time.After(time.Second):
+		c.Fatal("RunAllRooms did not return")
+	}
+}
+
+func (s *SupervisorSuite) TestRunAllRoomsAfterStop(c *C) {
+	b, _, err := MockBotWithRestart(RestartAlways)
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	result := make(chan error, 1)
+	go func() {
+		result <- b.RunAllRooms()
+	}()
+	room, _ := b.Room("test")
+	waitFor(c, func() bool { return room.State() == RoomConnected })
+	// A room stopped deliberately, as by !kill, is not restarted and leaves
+	// no room running.
+	c.Check(room.Stop(), IsNil)
+	select {
+	case err := <-result:
+		c.Check(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("RunAllRooms did not return after its only room was stopped")
+	}
+}
+
+func (s *SupervisorSuite) TestRunAllRoomsAfterLeave(c *C) {
+	b, _, err := MockBotWithRestart(RestartNever)
+	c.Assert(err, IsNil)
+	result := make(chan error, 1)
+	go func() {
+		result <- b.RunAllRooms()
+	}()
+	room, _ := b.Room("test")
+	waitFor(c, func() bool { return room.State() == RoomConnected })
+	c.Check(b.LeaveRoom("test"), IsNil)
+	select {
+	case <-result:
+		c.Fatal("RunAllRooms returned after a room was left")
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.Stop()
+	c.Check(<-result, IsNil)
+}
+
+func (s *SupervisorSuite) TestNeverRestart(c *C) {
+	b, conn, err := MockBotWithRestart(RestartNever)
+	c.Check(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	old, _ := b.Room("test")
+	conn.incoming <- disconnectPacket()
+	time.Sleep(100 * time.Millisecond)
+	room, _ := b.Room("test")
+	c.Check(room, Equals, old)
+	c.Check(room.Ctx.Alive(), Equals, false)
+}
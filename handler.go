@@ -10,6 +10,13 @@ import (
 // The Run method will be called when the Room is run. This allows a handler to
 // maintain state and send packets that are not in response to an incoming
 // packet.
+//
+// Handlers that implement EventHandler receive each packet as an *Event with
+// a payload decoded once for all handlers, instead of through HandleIncoming.
+//
+// Errors returned from HandleIncoming and panics in any of the methods are
+// recovered and handled according to the handler's ErrorPolicy; see
+// DispatchOptions.
 type Handler interface {
 	// HandleIncoming is called whenever a packet is received over the
 	// connection to euphoria. It is passed a pointer to the calling Room and
@@ -3,7 +3,9 @@ package handlers
 
 import (
 	"fmt"
+	"math"
 	"strings"
+	"sync"
 	"time"
 
 	"euphoria.io/heim/proto"
@@ -12,50 +14,29 @@ import (
 
 // PongHandler responds to a send-event starting with "!ping" and returns a send
 // command containing "pong!".
-type PongHandler struct{}
+type PongHandler struct {
+	gobot.BaseHandler
+}
 
-// HandleIncoming satisfies the Handler interface.
-func (ph *PongHandler) HandleIncoming(r *gobot.Room, p *proto.Packet) (*proto.Packet, error) {
+// OnSend checks incoming messages for the ping command.
+func (ph *PongHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
 	r.Logger.Debugln("Checking for ping command...")
-	if p.Type != proto.SendEventType {
-		return nil, nil
-	}
-	raw, err := p.Payload()
-	if err != nil {
-		return nil, err
-	}
-	payload, ok := raw.(*proto.SendEvent)
-	if !ok {
-		r.Logger.Warningln("Unable to assert packet as SendEvent.")
-		return nil, err
-	}
-	if !strings.HasPrefix(payload.Content, "!ping") {
-		return nil, nil
-	}
-	if strings.Contains(payload.Content, "@") && !strings.HasPrefix(payload.Content, "!ping @"+r.BotName) {
-		return nil, nil
+	if _, ok := pingRoute.Match(r.BotName, msg.Content); !ok {
+		return nil
 	}
 	r.Logger.Debugln("Sending !ping reply...")
-	if _, err := r.SendText(&payload.ID, "pong!"); err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
-
-// Run is a no-op- the PongHandler does not need to run continuously, only in
-// response to an incoming packet.
-func (ph *PongHandler) Run(r *gobot.Room) {
-	return
+	_, err := r.SendText(&msg.ID, "pong!")
+	return err
 }
 
-// Stop is also a no-op- there is nothing to stop.
-func (ph *PongHandler) Stop(r *gobot.Room) {
-	return
-}
+// BotProtocol marks PongHandler as part of the bot protocol, so that it keeps
+// answering while the room is paused.
+func (ph *PongHandler) BotProtocol() {}
 
 // UptimeHandler records the time when the bot goes up and responds to commands
 // with the duration the bot has been up.
 type UptimeHandler struct {
+	gobot.BaseHandler
 	t0 time.Time
 }
 
@@ -64,91 +45,193 @@ func (u *UptimeHandler) Run(r *gobot.Room) {
 	u.t0 = time.Now()
 }
 
-// HandleIncoming checks incoming commands for !uptime or !uptime @[BotName] and
+// OnSend checks incoming commands for !uptime or !uptime @[BotName] and
 // responds with the duration the bot has been up.
-func (u *UptimeHandler) HandleIncoming(r *gobot.Room, p *proto.Packet) (*proto.Packet, error) {
-	if p.Type != proto.SendEventType {
-		return nil, nil
-	}
-	raw, err := p.Payload()
-	if err != nil {
-		return nil, err
-	}
-	payload, ok := raw.(*proto.SendEvent)
-	if !ok {
-		r.Logger.Warningln("Unable to assert packet as SendEvent.")
-		return nil, err
-	}
-	if !strings.HasPrefix(payload.Content, "!uptime") {
-		return nil, nil
-	}
-	if payload.Content != "!uptime" && payload.Content != "!uptime @"+r.BotName {
-		return nil, nil
+func (u *UptimeHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
+	cmd, ok := uptimeRoute.Match(r.BotName, msg.Content)
+	if !ok || len(cmd.Args) > 0 {
+		return nil
 	}
 	uptime := time.Since(u.t0)
 	days := int(uptime.Hours()) / 24
 	hours := int(uptime.Hours()) % 24
 	minutes := int(uptime.Minutes()) % 60
-	seconds := int(uptime.Seconds()) % 60
-	if _, err := r.SendText(&payload.ID, fmt.Sprintf(
+	seconds := math.Mod(uptime.Seconds(), 60)
+	_, err := r.SendText(&msg.ID, fmt.Sprintf(
 		"This bot has been up for %dd %dh %dm %.3fs.",
-		days, hours, minutes, seconds)); err != nil {
-		return nil, err
-	}
-	return nil, nil
+		days, hours, minutes, seconds))
+	return err
 }
 
-// Stop is a no-op.
-func (u *UptimeHandler) Stop(r *gobot.Room) {
-	return
-}
+// BotProtocol marks UptimeHandler as part of the bot protocol.
+func (u *UptimeHandler) BotProtocol() {}
 
 // HelpHandler stores a short help message and a long help message and responds
-// with them to !help and !help @[BotName], respectively.
+// with them to !help and !help @[BotName], respectively. Use SetHelp to change
+// the messages while the bot is running.
 type HelpHandler struct {
+	gobot.BaseHandler
 	ShortDesc string
 	LongDesc  string
-}
 
-// Run is a no-op.
-func (h *HelpHandler) Run(r *gobot.Room) {
-	return
+	mu sync.RWMutex
 }
 
-// Stop is a no-op.
-func (h *HelpHandler) Stop(r *gobot.Room) {
-	return
+// SetHelp replaces the short and long help messages.
+func (h *HelpHandler) SetHelp(short, long string) {
+	h.mu.Lock()
+	h.ShortDesc = short
+	h.LongDesc = long
+	h.mu.Unlock()
 }
 
-// HandleIncoming checks incoming SendEvents for help commands and responds
+// OnSend checks incoming messages for help commands and responds
 // appropriately.
-func (h *HelpHandler) HandleIncoming(r *gobot.Room, p *proto.Packet) (*proto.Packet, error) {
-	if p.Type != proto.SendEventType {
-		return nil, nil
+func (h *HelpHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
+	cmd, ok := helpRoute.Match(r.BotName, msg.Content)
+	if !ok || len(cmd.Args) > 0 {
+		return nil
+	}
+	h.mu.RLock()
+	text := h.ShortDesc
+	if cmd.Mention != "" {
+		text = h.LongDesc
+	}
+	h.mu.RUnlock()
+	_, err := r.SendText(&msg.ID, text)
+	return err
+}
+
+// BotProtocol marks HelpHandler as part of the bot protocol.
+func (h *HelpHandler) BotProtocol() {}
+
+// KillHandler responds to !kill @[BotName] by saying goodbye and stopping the
+// room with Room.Stop, so that it is not restarted.
+type KillHandler struct {
+	gobot.BaseHandler
+}
+
+// OnSend checks incoming messages for the kill command.
+func (k *KillHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
+	if _, ok := killRoute.Match(r.BotName, msg.Content); !ok {
+		return nil
+	}
+	r.Logger.Warningf("Killed by %s", msg.Sender.Name)
+	if _, err := r.SendTextSync(&msg.ID, "/me is exiting.", gobot.DefaultCallTimeout); err != nil {
+		r.Logger.Errorf("Error sending kill reply: %s", err)
+	}
+	// Stop waits for the room's handlers to return, including this one.
+	go r.Stop()
+	return nil
+}
+
+// BotProtocol marks KillHandler as part of the bot protocol.
+func (k *KillHandler) BotProtocol() {}
+
+// PauseHandler responds to !pause @[BotName] by pausing the room and to
+// !restore @[BotName] by restoring it; see Room.Pause.
+type PauseHandler struct {
+	gobot.BaseHandler
+}
+
+// OnSend checks incoming messages for the pause and restore commands.
+func (ph *PauseHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
+	var reply string
+	if _, ok := pauseRoute.Match(r.BotName, msg.Content); ok {
+		if r.Paused() {
+			reply = "/me is already paused."
+		} else {
+			r.Pause()
+			reply = "/me is now paused."
+		}
+	} else if _, ok := restoreRoute.Match(r.BotName, msg.Content); ok {
+		if !r.Paused() {
+			reply = "/me is not paused."
+		} else {
+			r.Restore()
+			reply = "/me has been restored."
+		}
+	} else {
+		return nil
 	}
-	raw, err := p.Payload()
+	_, err := r.SendText(&msg.ID, reply)
+	return err
+}
+
+// BotProtocol marks PauseHandler as part of the bot protocol, so that it can
+// restore the room.
+func (ph *PauseHandler) BotProtocol() {}
+
+// DefaultSearchResults is the number of results SearchHandler replies with
+// when MaxResults is not set.
+const DefaultSearchResults = 5
+
+// SearchHandler responds to !search <terms> with links to the most recent
+// archived messages matching the terms; see gobot.ParseSearch for the syntax.
+// It needs the room to set Archive and Search, see gobot.RoomConfig.
+type SearchHandler struct {
+	gobot.BaseHandler
+	MaxResults int
+}
+
+// OnSend checks incoming messages for the search command and replies with the
+// results.
+func (sh *SearchHandler) OnSend(r *gobot.Room, msg *proto.SendEvent) error {
+	cmd, ok := searchRoute.Match(r.BotName, msg.Content)
+	if !ok {
+		return nil
+	}
+	q, err := gobot.ParseSearch(cmd.Text)
 	if err != nil {
-		return nil, err
+		_, err = r.SendText(&msg.ID, err.Error())
+		return err
 	}
-	payload, ok := raw.(*proto.SendEvent)
-	if !ok {
-		r.Logger.Warningln("Unable to assert packet as SendEvent.")
-		return nil, err
+	q.Limit = sh.MaxResults
+	if q.Limit <= 0 {
+		q.Limit = DefaultSearchResults
 	}
-	if !strings.HasPrefix(payload.Content, "!help") {
-		return nil, nil
+	// Leave out this command, earlier searches and the bot's own messages,
+	// including its earlier results, which match the terms they quote.
+	q.Filter = func(m *proto.Message) bool {
+		_, isSearch := searchRoute.Match(r.BotName, m.Content)
+		return m.ID != msg.ID && !isSearch && m.Sender.Name != r.BotName
 	}
-	if payload.Content != "!help @"+r.BotName && payload.Content != "!help" {
-		return nil, nil
+	results, err := r.Archive().Search(q)
+	if err != nil {
+		return err
 	}
-	if payload.Content == "!help" {
-		if _, err := r.SendText(&payload.ID, h.ShortDesc); err != nil {
-			return nil, err
-		}
-		return nil, nil
+	if len(results) == 0 {
+		_, err = r.SendText(&msg.ID, "No messages found.")
+		return err
+	}
+	lines := make([]string, len(results))
+	for i, m := range results {
+		lines[i] = fmt.Sprintf("%s, %s: %s %s", m.Sender.Name,
+			time.Time(m.UnixTime).UTC().Format("2006-01-02 15:04"),
+			snippet(m.Content, 80), r.MessageURL(m.ID))
 	}
-	if _, err := r.SendText(&payload.ID, h.LongDesc); err != nil {
-		return nil, err
+	_, err = r.SendText(&msg.ID, strings.Join(lines, "\n"))
+	return err
+}
+
+// snippet returns the first line of text, shortened to at most n runes.
+func snippet(text string, n int) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i] + " …"
+	}
+	if runes := []rune(text); len(runes) > n {
+		text = string(runes[:n-1]) + "…"
 	}
-	return nil, nil
+	return text
 }
+
+var (
+	pingRoute   = gobot.Route{Name: "ping"}
+	uptimeRoute = gobot.Route{Name: "uptime"}
+	helpRoute   = gobot.Route{Name: "help"}
+	searchRoute = gobot.Route{Name: "search", MinArgs: 1}
+
+	killRoute    = gobot.Route{Name: "kill", RequireMention: true}
+	pauseRoute   = gobot.Route{Name: "pause", RequireMention: true}
+	restoreRoute = gobot.Route{Name: "restore", RequireMention: true}
+)
@@ -0,0 +1,332 @@
+// Package heimtest provides an in-process fake heim server for testing bots
+// end to end over a real websocket connection.
+//
+// The server speaks enough of the heim protocol for a gobot.Room: it greets
+// each connection with a hello-event and a snapshot-event (or a bounce-event
+// if the room has a password), answers ping, nick, send, auth, log and who
+// commands, and broadcasts send, join, part and nick events. Simulated users
+// can be added to a room with Room.Join, and everything bots send is recorded
+// for tests to inspect.
+//
+// Point a bot at the server by setting the URL of its ServerConfig:
+//
+//	srv := heimtest.NewServer()
+//	defer srv.Close()
+//	cfg := gobot.BotConfig{Name: "TestBot", DbPath: path, Server: gobot.ServerConfig{URL: srv.URL}}
+package heimtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/gorilla/websocket"
+)
+
+// Version is the server version reported in hello and snapshot events.
+const Version = "heimtest"
+
+// Server is a fake heim server listening on a local port.
+type Server struct {
+	// URL is the base websocket URL of the server, such as
+	// "ws://127.0.0.1:12345".
+	URL string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	rooms  map[string]*Room
+	nextID uint64
+}
+
+// NewServer starts a server. It must be closed with Close.
+func NewServer() *Server {
+	s := &Server{rooms: make(map[string]*Room)}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http")
+	return s
+}
+
+// Close disconnects all sessions and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.Unlock()
+	for _, room := range rooms {
+		room.closeSessions()
+	}
+	s.srv.Close()
+}
+
+// Room returns the named room, creating it if it does not exist.
+func (s *Server) Room(name string) *Room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		room = newRoom(s, name)
+		s.rooms[name] = room
+	}
+	return room
+}
+
+// newID returns a unique number for session, agent and message IDs. IDs
+// increase over time, like snowflakes.
+func (s *Server) newID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "room" || parts[2] != "ws" || parts[1] == "" {
+		http.NotFound(w, req)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	s.Room(parts[1]).serve(conn)
+}
+
+// Room is a room on the fake server.
+type Room struct {
+	Name string
+
+	server *Server
+
+	mu       sync.Mutex
+	password string
+	sessions map[string]*session
+	users    map[string]*User
+	userIDs  map[string]bool
+	log      []proto.Message
+	received []*proto.Packet
+	changed  chan struct{}
+}
+
+func newRoom(s *Server, name string) *Room {
+	return &Room{
+		Name:     name,
+		server:   s,
+		sessions: make(map[string]*session),
+		users:    make(map[string]*User),
+		userIDs:  make(map[string]bool),
+		changed:  make(chan struct{}),
+	}
+}
+
+// SetPassword makes the room private. Sessions connecting afterwards are
+// bounced until they authenticate with the passcode.
+func (r *Room) SetPassword(password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.password = password
+}
+
+// notify wakes up anything waiting for the room to change. The caller must
+// hold r.mu.
+func (r *Room) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// waitFor calls cond, with r.mu held, until it returns true or the timeout
+// passes.
+func (r *Room) waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		ok := cond()
+		changed := r.changed
+		r.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// listing returns the simulated users and joined sessions other than except.
+// The caller must hold r.mu.
+func (r *Room) listing(except string) proto.Listing {
+	listing := proto.Listing{}
+	for _, u := range r.users {
+		listing = append(listing, u.view)
+	}
+	for id, sess := range r.sessions {
+		if id != except && sess.joined {
+			listing = append(listing, sess.view)
+		}
+	}
+	return listing
+}
+
+// broadcast sends a packet to every joined session other than except. The
+// caller must hold r.mu.
+func (r *Room) broadcast(except string, pType proto.PacketType, payload interface{}) {
+	for id, sess := range r.sessions {
+		if id != except && sess.joined {
+			sess.send("", pType, payload, "")
+		}
+	}
+}
+
+// post adds a message to the log and broadcasts it. The caller must hold r.mu.
+func (r *Room) post(sender proto.SessionView, parent snowflake.Snowflake, content string, except string) proto.Message {
+	msg := proto.Message{
+		ID:       snowflake.Snowflake(r.server.newID()),
+		Parent:   parent,
+		UnixTime: proto.Time(time.Now()),
+		Sender:   sender,
+		Content:  content,
+	}
+	r.log = append(r.log, msg)
+	r.broadcast(except, proto.SendEventType, proto.SendEvent(msg))
+	r.notify()
+	return msg
+}
+
+// Ping sends a ping-event to every session in the room.
+func (r *Room) Ping() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, sess := range r.sessions {
+		sess.send("", proto.PingEventType, proto.PingEvent{
+			UnixTime:     proto.Time(now),
+			NextUnixTime: proto.Time(now.Add(30 * time.Second)),
+		}, "")
+	}
+}
+
+// Disconnect sends a disconnect-event with the given reason to every session
+// in the room and closes their connections.
+func (r *Room) Disconnect(reason string) {
+	r.mu.Lock()
+	for _, sess := range r.sessions {
+		sess.send("", proto.DisconnectEventType, proto.DisconnectEvent{Reason: reason}, "")
+	}
+	r.mu.Unlock()
+	r.closeSessions()
+}
+
+func (r *Room) closeSessions() {
+	r.mu.Lock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	r.mu.Unlock()
+	for _, sess := range sessions {
+		sess.conn.Close()
+	}
+}
+
+// Log returns every message posted to the room, oldest first.
+func (r *Room) Log() []proto.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]proto.Message(nil), r.log...)
+}
+
+// Received returns every packet the room has received from connected
+// sessions, in order.
+func (r *Room) Received() []*proto.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*proto.Packet(nil), r.received...)
+}
+
+// Sessions returns the sessions connected to the room that have joined it,
+// that is, received a snapshot.
+func (r *Room) Sessions() []proto.SessionView {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var views []proto.SessionView
+	for _, sess := range r.sessions {
+		if sess.joined {
+			views = append(views, sess.view)
+		}
+	}
+	return views
+}
+
+// WaitForSessions waits until at least n sessions have joined the room.
+func (r *Room) WaitForSessions(n int, timeout time.Duration) error {
+	ok := r.waitFor(timeout, func() bool {
+		joined := 0
+		for _, sess := range r.sessions {
+			if sess.joined {
+				joined++
+			}
+		}
+		return joined >= n
+	})
+	if !ok {
+		return fmt.Errorf("Timed out waiting for %d sessions to join %s", n, r.Name)
+	}
+	return nil
+}
+
+// WaitForPacket waits until the room has received a packet from a session
+// for which match returns true, and returns it. Packets received before the
+// call are included.
+func (r *Room) WaitForPacket(match func(p *proto.Packet) bool, timeout time.Duration) (*proto.Packet, error) {
+	var found *proto.Packet
+	ok := r.waitFor(timeout, func() bool {
+		for _, p := range r.received {
+			if match(p) {
+				found = p
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		return nil, fmt.Errorf("Timed out waiting for packet in %s", r.Name)
+	}
+	return found, nil
+}
+
+// WaitForMessage waits until a connected session, rather than a simulated
+// user, has posted a message for which match returns true, and returns it.
+func (r *Room) WaitForMessage(match func(msg proto.Message) bool, timeout time.Duration) (proto.Message, error) {
+	var found proto.Message
+	ok := r.waitFor(timeout, func() bool {
+		for _, msg := range r.log {
+			if !r.userIDs[msg.Sender.SessionID] && match(msg) {
+				found = msg
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		return proto.Message{}, fmt.Errorf("Timed out waiting for message in %s", r.Name)
+	}
+	return found, nil
+}
+
+// WaitForContent waits until a connected session has posted a message with
+// the given content, and returns it.
+func (r *Room) WaitForContent(content string, timeout time.Duration) (proto.Message, error) {
+	return r.WaitForMessage(func(msg proto.Message) bool { return msg.Content == content }, timeout)
+}
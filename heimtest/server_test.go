@@ -0,0 +1,206 @@
+package heimtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+
+	"github.com/cpalone/gobot"
+	"github.com/cpalone/gobot/handlers"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct {
+	srv *Server
+	dir string
+	bot *gobot.Bot
+}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	s.srv = NewServer()
+	dir, err := ioutil.TempDir("", "heimtest")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.bot, err = gobot.NewBot(gobot.BotConfig{
+		Name:   "TestBot",
+		DbPath: filepath.Join(dir, "test.db"),
+		Server: gobot.ServerConfig{URL: s.srv.URL},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	s.bot.Stop()
+	s.srv.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *ServerSuite) addRoom(name, password string) {
+	s.bot.AddRoom(gobot.RoomConfig{
+		RoomName:     name,
+		Password:     password,
+		AddlHandlers: []gobot.Handler{&handlers.PongHandler{}},
+		Conn:         &gobot.WSConnection{},
+	})
+}
+
+func (s *ServerSuite) TestPingPong(c *C) {
+	s.addRoom("test", "")
+	go s.bot.RunAllRooms()
+	room := s.srv.Room("test")
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	_, err := room.WaitForPacket(func(p *proto.Packet) bool {
+		return p.Type == proto.NickType
+	}, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(room.Sessions()[0].Name, Equals, "TestBot")
+
+	alice := room.Join("alice")
+	reply, err := alice.SendAndWait("!ping", 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(reply.Content, Equals, "pong!")
+	c.Check(reply.Sender.Name, Equals, "TestBot")
+
+	bot, _ := s.bot.Room("test")
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return bot.IsPresent(alice.Session().SessionID) })
+	c.Check(bot.IsPresent(alice.Session().SessionID), Equals, true)
+	alice.Part()
+	waitFor(func() bool { return !bot.IsPresent(alice.Session().SessionID) })
+	c.Check(bot.IsPresent(alice.Session().SessionID), Equals, false)
+}
+
+func (s *ServerSuite) TestPingEvent(c *C) {
+	s.addRoom("test", "")
+	go s.bot.RunAllRooms()
+	room := s.srv.Room("test")
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	room.Ping()
+	_, err := room.WaitForPacket(func(p *proto.Packet) bool {
+		return p.Type == proto.PingReplyType
+	}, 5*time.Second)
+	c.Check(err, IsNil)
+}
+
+func (s *ServerSuite) TestAuth(c *C) {
+	room := s.srv.Room("private")
+	room.SetPassword("hunter2")
+	s.addRoom("private", "hunter2")
+	go s.bot.RunAllRooms()
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	auth, err := room.WaitForPacket(func(p *proto.Packet) bool {
+		return p.Type == proto.AuthType
+	}, time.Second)
+	c.Assert(err, IsNil)
+	payload, err := auth.Payload()
+	c.Assert(err, IsNil)
+	c.Check(payload.(*proto.AuthCommand).Passcode, Equals, "hunter2")
+}
+
+func (s *ServerSuite) TestBounce(c *C) {
+	room := s.srv.Room("private")
+	room.SetPassword("hunter2")
+	s.addRoom("private", "wrong")
+	go s.bot.RunAllRooms()
+	_, err := room.WaitForPacket(func(p *proto.Packet) bool {
+		return p.Type == proto.AuthType
+	}, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(room.WaitForSessions(1, 100*time.Millisecond), NotNil)
+}
+
+func (s *ServerSuite) TestDisconnect(c *C) {
+	s.addRoom("test", "")
+	go s.bot.RunAllRooms()
+	room := s.srv.Room("test")
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	bot, _ := s.bot.Room("test")
+	room.Disconnect("shutting down")
+	select {
+	case <-bot.Ctx.Done():
+	case <-time.After(5 * time.Second):
+		c.Fatal("room was not stopped by disconnect-event")
+	}
+	c.Check(bot.Ctx.Err(), ErrorMatches, ".*shutting down.*")
+}
+
+func (s *ServerSuite) TestLog(c *C) {
+	room := s.srv.Room("test")
+	alice := room.Join("alice")
+	first := alice.Send("first")
+	alice.Reply(first.ID, "second")
+	s.addRoom("test", "")
+	go s.bot.RunAllRooms()
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	bot, _ := s.bot.Room("test")
+	msgs, err := bot.History(0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 2)
+	c.Check(msgs[1].Parent, Equals, first.ID)
+}
+
+func (s *ServerSuite) TestSearchTwice(c *C) {
+	s.bot.AddRoom(gobot.RoomConfig{
+		RoomName:     "test",
+		Archive:      true,
+		Search:       true,
+		AddlHandlers: []gobot.Handler{&handlers.SearchHandler{}},
+		Conn:         &gobot.WSConnection{},
+	})
+	go s.bot.RunAllRooms()
+	room := s.srv.Room("test")
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	alice := room.Join("alice")
+	sent := alice.Send("cats are great")
+	bot, _ := s.bot.Room("test")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok, err := bot.Archive().Message(sent.ID)
+		c.Assert(err, IsNil)
+		if ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The second search must not find the results of the first.
+	for i := 0; i < 2; i++ {
+		reply, err := alice.SendAndWait("!search cats", 5*time.Second)
+		c.Assert(err, IsNil)
+		c.Check(reply.Content, Matches, "alice, [^\n]*: cats are great [^\n]*")
+	}
+}
+
+func (s *ServerSuite) TestKillStopsBot(c *C) {
+	s.bot.AddRoom(gobot.RoomConfig{
+		RoomName:     "test",
+		AddlHandlers: []gobot.Handler{&handlers.KillHandler{}},
+		Conn:         &gobot.WSConnection{},
+	})
+	result := make(chan error, 1)
+	go func() {
+		result <- s.bot.RunAllRooms()
+	}()
+	room := s.srv.Room("test")
+	c.Assert(room.WaitForSessions(1, 5*time.Second), IsNil)
+	alice := room.Join("alice")
+	alice.Send("!kill @TestBot")
+	select {
+	case err := <-result:
+		c.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("RunAllRooms did not return after !kill")
+	}
+}
@@ -0,0 +1,185 @@
+package heimtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"euphoria.io/heim/proto"
+	"github.com/gorilla/websocket"
+)
+
+// logLimit is the number of messages included in a snapshot.
+const logLimit = 100
+
+// session is a websocket connection to a room.
+type session struct {
+	room    *Room
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	view    proto.SessionView
+	joined  bool
+}
+
+// send writes a packet to the session, ignoring errors; a broken connection is
+// noticed by the read loop.
+func (sess *session) send(id string, pType proto.PacketType, payload interface{}, errMsg string) {
+	p := &proto.Packet{ID: id, Type: pType, Error: errMsg}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			panic(fmt.Sprintf("heimtest: could not marshal %s payload: %s", pType, err))
+		}
+		p.Data = data
+	}
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.conn.WriteJSON(p)
+}
+
+// serve greets a new connection and handles its commands until it closes.
+func (r *Room) serve(conn *websocket.Conn) {
+	n := r.server.newID()
+	sess := &session{
+		room: r,
+		conn: conn,
+		view: proto.SessionView{
+			IdentityView: proto.IdentityView{
+				ID:        proto.UserID(fmt.Sprintf("agent:%d", n)),
+				ServerID:  Version,
+				ServerEra: Version,
+			},
+			SessionID: fmt.Sprintf("session-%d", n),
+		},
+	}
+
+	r.mu.Lock()
+	r.sessions[sess.view.SessionID] = sess
+	sess.send("", proto.HelloEventType, proto.HelloEvent{
+		ID:            sess.view.ID,
+		SessionView:   sess.view,
+		RoomIsPrivate: r.password != "",
+		Version:       Version,
+	}, "")
+	if r.password != "" {
+		sess.send("", proto.BounceEventType, proto.BounceEvent{
+			Reason:      "authentication required",
+			AuthOptions: []proto.AuthOption{"passcode"},
+		}, "")
+	} else {
+		r.join(sess)
+	}
+	r.notify()
+	r.mu.Unlock()
+
+	defer r.part(sess)
+	for {
+		var p proto.Packet
+		if err := conn.ReadJSON(&p); err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.received = append(r.received, &p)
+		r.handle(sess, &p)
+		r.notify()
+		r.mu.Unlock()
+	}
+}
+
+// join sends the session a snapshot and announces it to the room. The caller
+// must hold r.mu.
+func (r *Room) join(sess *session) {
+	log := r.log
+	if len(log) > logLimit {
+		log = log[len(log)-logLimit:]
+	}
+	sess.send("", proto.SnapshotEventType, proto.SnapshotEvent{
+		Identity:  sess.view.ID,
+		SessionID: sess.view.SessionID,
+		Version:   Version,
+		Listing:   r.listing(sess.view.SessionID),
+		Log:       append([]proto.Message{}, log...),
+	}, "")
+	sess.joined = true
+	r.broadcast(sess.view.SessionID, proto.JoinEventType, proto.PresenceEvent(sess.view))
+}
+
+// part removes a closed session from the room.
+func (r *Room) part(sess *session) {
+	sess.conn.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sess.view.SessionID)
+	if sess.joined {
+		r.broadcast(sess.view.SessionID, proto.PartEventType, proto.PresenceEvent(sess.view))
+	}
+	r.notify()
+}
+
+// handle answers a command from a session. The caller must hold r.mu.
+func (r *Room) handle(sess *session, p *proto.Packet) {
+	reply := p.Type.Reply()
+	payload, err := p.Payload()
+	if err != nil {
+		sess.send(p.ID, reply, nil, err.Error())
+		return
+	}
+	if !sess.joined && p.Type != proto.AuthType && p.Type != proto.PingType && p.Type != proto.PingReplyType {
+		sess.send(p.ID, reply, nil, "access denied")
+		return
+	}
+	switch cmd := payload.(type) {
+	case *proto.PingReply:
+	case *proto.PingCommand:
+		sess.send(p.ID, reply, proto.PingReply{UnixTime: cmd.UnixTime}, "")
+	case *proto.AuthCommand:
+		if sess.joined || r.password == "" {
+			sess.send(p.ID, reply, proto.AuthReply{Success: true}, "")
+			return
+		}
+		if cmd.Passcode != r.password {
+			sess.send(p.ID, reply, proto.AuthReply{Reason: "passcode incorrect"}, "")
+			return
+		}
+		sess.send(p.ID, reply, proto.AuthReply{Success: true}, "")
+		r.join(sess)
+	case *proto.NickCommand:
+		from := sess.view.Name
+		sess.view.Name = cmd.Name
+		nick := proto.NickReply{
+			SessionID: sess.view.SessionID,
+			ID:        sess.view.ID,
+			From:      from,
+			To:        cmd.Name,
+		}
+		sess.send(p.ID, reply, nick, "")
+		r.broadcast(sess.view.SessionID, proto.NickEventType, proto.NickEvent(nick))
+	case *proto.SendCommand:
+		msg := r.post(sess.view, cmd.Parent, cmd.Content, sess.view.SessionID)
+		sess.send(p.ID, reply, proto.SendReply(msg), "")
+	case *proto.LogCommand:
+		sess.send(p.ID, reply, r.logReply(cmd), "")
+	case *proto.WhoCommand:
+		sess.send(p.ID, reply, proto.WhoReply{Listing: r.listing("")}, "")
+	default:
+		sess.send(p.ID, reply, nil, fmt.Sprintf("heimtest: unsupported command %s", p.Type))
+	}
+}
+
+// logReply answers a log command. The caller must hold r.mu.
+func (r *Room) logReply(cmd *proto.LogCommand) proto.LogReply {
+	end := len(r.log)
+	if cmd.Before != 0 {
+		for end > 0 && r.log[end-1].ID >= cmd.Before {
+			end--
+		}
+	}
+	start := end - cmd.N
+	if start < 0 {
+		start = 0
+	}
+	return proto.LogReply{
+		Log:    append([]proto.Message{}, r.log[start:end]...),
+		Before: cmd.Before,
+	}
+}
@@ -0,0 +1,92 @@
+package heimtest
+
+import (
+	"fmt"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+)
+
+// User is a simulated user in a room. Its actions are broadcast to the
+// sessions connected to the room as if it were connected itself.
+type User struct {
+	room *Room
+	view proto.SessionView
+}
+
+// Join adds a simulated user with the given nick to the room.
+func (r *Room) Join(nick string) *User {
+	n := r.server.newID()
+	u := &User{
+		room: r,
+		view: proto.SessionView{
+			IdentityView: proto.IdentityView{
+				ID:        proto.UserID(fmt.Sprintf("agent:user%d", n)),
+				Name:      nick,
+				ServerID:  Version,
+				ServerEra: Version,
+			},
+			SessionID: fmt.Sprintf("user-%d", n),
+		},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[u.view.SessionID] = u
+	r.userIDs[u.view.SessionID] = true
+	r.broadcast("", proto.JoinEventType, proto.PresenceEvent(u.view))
+	r.notify()
+	return u
+}
+
+// Session returns the user's session.
+func (u *User) Session() proto.SessionView {
+	u.room.mu.Lock()
+	defer u.room.mu.Unlock()
+	return u.view
+}
+
+// Send posts a message to the room and returns it.
+func (u *User) Send(content string) proto.Message {
+	return u.Reply(0, content)
+}
+
+// Reply posts a reply to the given message and returns it.
+func (u *User) Reply(parent snowflake.Snowflake, content string) proto.Message {
+	u.room.mu.Lock()
+	defer u.room.mu.Unlock()
+	return u.room.post(u.view, parent, content, "")
+}
+
+// SetNick changes the user's nick.
+func (u *User) SetNick(nick string) {
+	u.room.mu.Lock()
+	defer u.room.mu.Unlock()
+	from := u.view.Name
+	u.view.Name = nick
+	u.room.broadcast("", proto.NickEventType, proto.NickEvent{
+		SessionID: u.view.SessionID,
+		ID:        u.view.ID,
+		From:      from,
+		To:        nick,
+	})
+	u.room.notify()
+}
+
+// Part removes the user from the room.
+func (u *User) Part() {
+	u.room.mu.Lock()
+	defer u.room.mu.Unlock()
+	delete(u.room.users, u.view.SessionID)
+	u.room.broadcast("", proto.PartEventType, proto.PresenceEvent(u.view))
+	u.room.notify()
+}
+
+// SendAndWait posts a message and waits for a connected session to reply to
+// it, returning the reply.
+func (u *User) SendAndWait(content string, timeout time.Duration) (proto.Message, error) {
+	msg := u.Send(content)
+	return u.room.WaitForMessage(func(reply proto.Message) bool {
+		return reply.Parent == msg.ID
+	}, timeout)
+}
@@ -0,0 +1,221 @@
+package gobot
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+)
+
+const (
+	// DefaultHistorySize is the number of messages a room caches when
+	// RoomConfig.HistorySize is zero.
+	DefaultHistorySize = 500
+
+	// maxLogPage is the most messages requested by a single get-log command.
+	maxLogPage = 1000
+)
+
+// messageCache holds the most recent messages in a room, ordered by ID. It is
+// always a contiguous run of the room's log: it is reset from the log in each
+// snapshot, extended by new messages as they arrive, and only extended
+// backwards with messages immediately preceding its oldest one. A nil
+// *messageCache holds nothing.
+//
+// replies indexes the IDs of the cached replies to each message, oldest first;
+// see thread.go.
+type messageCache struct {
+	mu      sync.RWMutex
+	size    int
+	msgs    []proto.Message
+	replies map[snowflake.Snowflake][]snowflake.Snowflake
+}
+
+// newMessageCache returns a cache for the given number of messages, or nil if
+// size is negative.
+func newMessageCache(size int) *messageCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+	return &messageCache{size: size}
+}
+
+// find returns the index of the message with the given ID, or where it would
+// be inserted.
+func (mc *messageCache) find(id snowflake.Snowflake) int {
+	return sort.Search(len(mc.msgs), func(i int) bool { return mc.msgs[i].ID >= id })
+}
+
+// trim drops the oldest messages until the cache fits its size.
+func (mc *messageCache) trim() {
+	if extra := len(mc.msgs) - mc.size; extra > 0 {
+		for _, msg := range mc.msgs[:extra] {
+			mc.unlink(msg)
+		}
+		mc.msgs = append([]proto.Message(nil), mc.msgs[extra:]...)
+	}
+}
+
+// reset replaces the cached messages with a log from the server, oldest first.
+func (mc *messageCache) reset(log []proto.Message) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.msgs = append([]proto.Message(nil), log...)
+	mc.replies = nil
+	for _, msg := range mc.msgs {
+		mc.link(msg)
+	}
+	mc.trim()
+}
+
+// add caches a new message, or replaces the cached message with the same ID.
+// Messages older than the oldest cached one are ignored.
+func (mc *messageCache) add(msg proto.Message) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	i := mc.find(msg.ID)
+	switch {
+	case i < len(mc.msgs) && mc.msgs[i].ID == msg.ID:
+		mc.msgs[i] = msg
+		return
+	case i == 0 && len(mc.msgs) > 0:
+		return
+	}
+	mc.msgs = append(mc.msgs, proto.Message{})
+	copy(mc.msgs[i+1:], mc.msgs[i:])
+	mc.msgs[i] = msg
+	mc.link(msg)
+	mc.trim()
+}
+
+// update replaces the cached message with the same ID, if there is one.
+func (mc *messageCache) update(msg proto.Message) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if i := mc.find(msg.ID); i < len(mc.msgs) && mc.msgs[i].ID == msg.ID {
+		mc.msgs[i] = msg
+	}
+}
+
+// prepend caches a log of messages, oldest first, that the server sent as
+// preceding next, as far as there is room. It is ignored unless it extends the
+// cache without a gap.
+func (mc *messageCache) prepend(log []proto.Message, next snowflake.Snowflake) {
+	if mc == nil || len(log) == 0 {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if (len(mc.msgs) == 0 && next != 0) || (len(mc.msgs) > 0 && mc.msgs[0].ID != next) {
+		return
+	}
+	room := mc.size - len(mc.msgs)
+	if room <= 0 {
+		return
+	}
+	if len(log) > room {
+		log = log[len(log)-room:]
+	}
+	for _, msg := range log {
+		mc.link(msg)
+	}
+	mc.msgs = append(append([]proto.Message(nil), log...), mc.msgs...)
+}
+
+// before returns up to n cached messages preceding the given ID, or the most
+// recent messages if before is zero, oldest first.
+func (mc *messageCache) before(before snowflake.Snowflake, n int) []proto.Message {
+	if mc == nil {
+		return nil
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	end := len(mc.msgs)
+	if before != 0 {
+		end = mc.find(before)
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	return append([]proto.Message(nil), mc.msgs[start:end]...)
+}
+
+// trackHistory updates the room's message cache from snapshots, messages and
+// edits. It runs in the dispatcher before the event reaches the handlers.
+func (r *Room) trackHistory(ev *Event) {
+	switch ev.Type() {
+	case proto.SnapshotEventType, proto.SendEventType, proto.SendReplyType, proto.EditMessageEventType:
+	default:
+		return
+	}
+	if ev.packet.Error != "" {
+		return
+	}
+	payload, err := ev.Payload()
+	if err != nil {
+		return
+	}
+	switch e := payload.(type) {
+	case *proto.SnapshotEvent:
+		r.history.reset(e.Log)
+	case *proto.SendEvent:
+		r.history.add(proto.Message(*e))
+	case *proto.SendReply:
+		r.history.add(proto.Message(*e))
+	case *proto.EditMessageEvent:
+		r.history.update(e.Message)
+	}
+}
+
+// History returns up to n messages sent before the given message, or the most
+// recent messages if before is zero, oldest first. Messages are taken from the
+// room's cache as far as it goes back; older messages are fetched from the
+// server with get-log, which blocks until the server replies. All of the
+// get-log calls together are given DefaultCallTimeout. Fewer than n messages
+// are returned if the room's log has no more.
+func (r *Room) History(before snowflake.Snowflake, n int) ([]proto.Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	msgs := r.history.before(before, n)
+	deadline := time.Now().Add(DefaultCallTimeout)
+	for len(msgs) < n {
+		next := before
+		if len(msgs) > 0 {
+			next = msgs[0].ID
+		}
+		want := n - len(msgs)
+		if want > maxLogPage {
+			want = maxLogPage
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, ErrCallTimeout
+		}
+		reply, err := r.LogSync(want, next, left)
+		if err != nil {
+			return nil, err
+		}
+		r.history.prepend(reply.Log, next)
+		msgs = append(append([]proto.Message(nil), reply.Log...), msgs...)
+		if len(reply.Log) < want {
+			break
+		}
+	}
+	return msgs, nil
+}
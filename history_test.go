@@ -0,0 +1,94 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	. "gopkg.in/check.v1"
+)
+
+func message(id snowflake.Snowflake, content string) proto.Message {
+	return proto.Message{ID: id, Content: content}
+}
+
+func messageIDs(msgs []proto.Message) []snowflake.Snowflake {
+	ids := make([]snowflake.Snowflake, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+type HistorySuite struct{}
+
+var _ = Suite(&HistorySuite{})
+
+func (s *HistorySuite) TestCacheBounded(c *C) {
+	mc := newMessageCache(3)
+	mc.reset([]proto.Message{message(1, "a"), message(2, "b")})
+	mc.add(message(3, "c"))
+	mc.add(message(4, "d"))
+	c.Check(messageIDs(mc.before(0, 10)), DeepEquals, []snowflake.Snowflake{2, 3, 4})
+	mc.add(message(1, "too old"))
+	c.Check(messageIDs(mc.before(0, 10)), DeepEquals, []snowflake.Snowflake{2, 3, 4})
+	mc.update(message(3, "edited"))
+	c.Check(mc.before(4, 1)[0].Content, Equals, "edited")
+	mc.prepend([]proto.Message{message(1, "a")}, 2)
+	c.Check(messageIDs(mc.before(0, 10)), DeepEquals, []snowflake.Snowflake{2, 3, 4})
+
+	var disabled *messageCache = newMessageCache(-1)
+	disabled.add(message(1, "a"))
+	c.Check(disabled.before(0, 10), HasLen, 0)
+}
+
+func (s *HistorySuite) TestHistory(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	h := newEventHandler()
+	room.Handlers = []Handler{h}
+	go room.Run()
+
+	snapshot, _ := MakePacket(proto.SnapshotEventType, proto.SnapshotEvent{
+		Log: []proto.Message{message(10, "a"), message(11, "b"), message(12, "c")},
+	})
+	conn.incoming <- snapshot
+	send, _ := MakePacket(proto.SendEventType, proto.SendEvent(message(13, "d")))
+	conn.incoming <- send
+	edit, _ := MakePacket(proto.EditMessageEventType, proto.EditMessageEvent{Message: message(11, "edited")})
+	conn.incoming <- edit
+	<-h.events
+	waitFor(c, func() bool {
+		msgs := room.history.before(12, 1)
+		return len(msgs) == 1 && msgs[0].Content == "edited"
+	})
+
+	msgs, err := room.History(0, 2)
+	c.Assert(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{12, 13})
+
+	done := make(chan *proto.Packet)
+	go func() {
+		done <- answer(conn, proto.LogReplyType, proto.LogReply{
+			Log: []proto.Message{message(8, "y"), message(9, "z")},
+		}, "")
+	}()
+	msgs, err = room.History(11, 3)
+	c.Assert(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{8, 9, 10})
+	select {
+	case p := <-done:
+		payload, err := p.Payload()
+		c.Assert(err, IsNil)
+		c.Check(*payload.(*proto.LogCommand), Equals, proto.LogCommand{N: 2, Before: 10})
+	case <-time.After(time.Second):
+		c.Fatal("get-log was not sent")
+	}
+
+	// The fetched messages extend the cache, so no further get-log is sent.
+	msgs, err = room.History(10, 2)
+	c.Assert(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{8, 9})
+}
@@ -0,0 +1,364 @@
+package gobot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"euphoria.io/heim/proto"
+)
+
+// MetricsPath is the path at which the metrics listener serves metrics.
+const MetricsPath = "/metrics"
+
+// pingInterval is how often each room measures the round trip to the server.
+const pingInterval = 30 * time.Second
+
+var (
+	latencyBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10}
+	pingBuckets    = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+// counterFamily is a set of counters with the same name, one per combination
+// of label values.
+type counterFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterFamily(name, help string, labels ...string) *counterFamily {
+	return &counterFamily{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)}
+}
+
+func newGaugeFamily(name, help string, labels ...string) *counterFamily {
+	f := newCounterFamily(name, help, labels...)
+	f.kind = "gauge"
+	return f
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramFamily is a set of histograms with the same name and buckets, one
+// per combination of label values.
+type histogramFamily struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramFamily(name, help string, buckets []float64, labels ...string) *histogramFamily {
+	return &histogramFamily{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// metrics holds the counters and histograms of a bot and its rooms. It outlives
+// restarts of the rooms, so counters keep increasing. A nil *metrics discards
+// everything.
+type metrics struct {
+	mu             sync.Mutex
+	received       *counterFamily
+	sent           *counterFamily
+	lastReceived   *counterFamily
+	handlerLatency *histogramFamily
+	handlerErrors  *counterFamily
+	handlerDropped *counterFamily
+	reconnects     *counterFamily
+	restarts       *counterFamily
+	pingRTT        *histogramFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		received: newCounterFamily("gobot_packets_received_total",
+			"Packets received from the server.", "room", "type"),
+		sent: newCounterFamily("gobot_packets_sent_total",
+			"Packets sent to the server.", "room", "type"),
+		lastReceived: newGaugeFamily("gobot_last_packet_received_timestamp_seconds",
+			"Unix time at which the last packet was received.", "room"),
+		handlerLatency: newHistogramFamily("gobot_handler_duration_seconds",
+			"Time taken by handlers to handle a packet.", latencyBuckets, "room", "handler"),
+		handlerErrors: newCounterFamily("gobot_handler_errors_total",
+			"Errors and panics in handlers.", "room", "handler"),
+		handlerDropped: newCounterFamily("gobot_handler_dropped_total",
+			"Packets dropped because a handler's queue was full.", "room", "handler"),
+		reconnects: newCounterFamily("gobot_reconnects_total",
+			"Reconnections after the connection to the server was lost.", "room"),
+		restarts: newCounterFamily("gobot_room_restarts_total",
+			"Restarts of rooms by their supervisor.", "room"),
+		pingRTT: newHistogramFamily("gobot_ping_rtt_seconds",
+			"Round trip time of ping commands sent to the server.", pingBuckets, "room"),
+	}
+}
+
+// seriesKey joins label values into a map key.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+func (m *metrics) add(f *counterFamily, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	f.values[seriesKey(labels)] += v
+	m.mu.Unlock()
+}
+
+func (m *metrics) set(f *counterFamily, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	f.values[seriesKey(labels)] = v
+	m.mu.Unlock()
+}
+
+func (m *metrics) observe(f *histogramFamily, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := seriesKey(labels)
+	h, ok := f.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(f.buckets))}
+		f.values[key] = h
+	}
+	for i, le := range f.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (m *metrics) packetReceived(room string, pType proto.PacketType) {
+	if m == nil {
+		return
+	}
+	m.add(m.received, 1, room, string(pType))
+	m.set(m.lastReceived, float64(time.Now().UnixNano())/1e9, room)
+}
+
+func (m *metrics) packetSent(room string, pType proto.PacketType) {
+	if m == nil {
+		return
+	}
+	m.add(m.sent, 1, room, string(pType))
+}
+
+func (m *metrics) dropped(room string, h Handler) {
+	if m == nil {
+		return
+	}
+	m.add(m.handlerDropped, 1, room, handlerName(h))
+}
+
+func (m *metrics) reconnected(room string) {
+	if m == nil {
+		return
+	}
+	m.add(m.reconnects, 1, room)
+}
+
+func (m *metrics) restarted(room string) {
+	if m == nil {
+		return
+	}
+	m.add(m.restarts, 1, room)
+}
+
+func (m *metrics) pinged(room string, rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	m.observe(m.pingRTT, rtt.Seconds(), room)
+}
+
+func (m *metrics) handled(room string, h Handler, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	name := handlerName(h)
+	m.observe(m.handlerLatency, d.Seconds(), room, name)
+	if err != nil {
+		m.add(m.handlerErrors, 1, room, name)
+	}
+}
+
+// write writes the metrics in the Prometheus text format, followed by gauges
+// describing the current state of the given rooms.
+func (m *metrics) write(w io.Writer, rooms []*Room) error {
+	queued := newGaugeFamily("gobot_outbound_queue_depth",
+		"Packets waiting to be sent to the server.", "room")
+	handlerQueued := newGaugeFamily("gobot_handler_queue_depth",
+		"Packets waiting for a handler.", "room", "handler")
+	paused := newGaugeFamily("gobot_room_paused",
+		"Whether the room is paused.", "room")
+	for _, r := range rooms {
+		queued.values[seriesKey([]string{r.RoomName})] = float64(atomic.LoadInt64(&r.queued))
+		p := 0.0
+		if r.Paused() {
+			p = 1
+		}
+		paused.values[seriesKey([]string{r.RoomName})] = p
+		r.workersMu.RLock()
+		for _, worker := range r.workers {
+			key := seriesKey([]string{r.RoomName, handlerName(worker.handler)})
+			handlerQueued.values[key] += float64(len(worker.queue))
+		}
+		r.workersMu.RUnlock()
+	}
+
+	bw := bufio.NewWriter(w)
+	m.mu.Lock()
+	for _, f := range []*counterFamily{m.received, m.sent, m.lastReceived} {
+		writeCounters(bw, f)
+	}
+	writeHistograms(bw, m.handlerLatency)
+	for _, f := range []*counterFamily{m.handlerErrors, m.handlerDropped, m.reconnects, m.restarts} {
+		writeCounters(bw, f)
+	}
+	writeHistograms(bw, m.pingRTT)
+	m.mu.Unlock()
+	for _, f := range []*counterFamily{queued, handlerQueued, paused} {
+		writeCounters(bw, f)
+	}
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounters(w io.Writer, f *counterFamily) {
+	writeHeader(w, f.name, f.help, f.kind)
+	for _, key := range sortedKeys(f.values) {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, key, ""), formatValue(f.values[key]))
+	}
+}
+
+func writeHistograms(w io.Writer, f *histogramFamily) {
+	writeHeader(w, f.name, f.help, "histogram")
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := f.values[key]
+		for i, le := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, key, formatValue(le)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, key, "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, key, ""), formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, key, ""), h.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label names with the values joined in key, adding
+// an le label if it is set.
+func formatLabels(names []string, key, le string) string {
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler returns an http.Handler serving the bot's metrics in the
+// Prometheus text format.
+func (b *Bot) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := b.metrics.write(w, b.rooms()); err != nil {
+			b.Logger.Warningf("Error writing metrics: %s", err)
+		}
+	})
+}
+
+// serveMetrics listens on the configured metrics address until the bot's
+// context is finished.
+func (b *Bot) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, b.MetricsHandler())
+	return b.serveHTTP("metrics", addr, mux)
+}
+
+// serveHTTP serves handler on addr until the bot's context is finished. The
+// listener is opened before serveHTTP returns, so that errors such as an
+// address in use are reported to the caller.
+func (b *Bot) serveHTTP(name, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler}
+	b.Logger.Infof("Serving %s on http://%s", name, ln.Addr())
+	b.ctx.WaitGroup().Add(1)
+	go func() {
+		defer b.ctx.WaitGroup().Done()
+		<-b.ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			b.Logger.Errorf("Error serving %s: %s", name, err)
+		}
+	}()
+	return nil
+}
+
+// measurePing sends a ping command to the server and records the time until
+// the reply arrives. The command goes on the priority queue, so that the time
+// spent waiting for the rate limiters is not counted.
+func (r *Room) measurePing() {
+	start := time.Now()
+	_, err := r.call(r.priority, proto.PingType, proto.PingCommand{UnixTime: proto.Time(start)}, DefaultCallTimeout)
+	if err != nil {
+		r.Logger.Debugf("Error measuring ping: %s", err)
+		return
+	}
+	r.metrics.pinged(r.RoomName, time.Since(start))
+}
@@ -0,0 +1,93 @@
+package gobot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+// replyHandler answers every send-event with a send command.
+type replyHandler struct {
+	BaseHandler
+}
+
+func (h *replyHandler) OnSend(r *Room, e *proto.SendEvent) error {
+	r.SendText(&e.ID, "reply")
+	return nil
+}
+
+func (s *MetricsSuite) TestFormat(c *C) {
+	m := newMetrics()
+	m.packetReceived("a \"room\"", proto.SendEventType)
+	m.packetReceived("a \"room\"", proto.SendEventType)
+	m.handled("b", &replyHandler{}, 20*time.Millisecond, nil)
+	m.handled("b", &replyHandler{}, 2*time.Second, errReadOnly)
+	m.pinged("b", 75*time.Millisecond)
+
+	var buf bytes.Buffer
+	c.Assert(m.write(&buf, nil), IsNil)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE gobot_packets_received_total counter",
+		`gobot_packets_received_total{room="a \"room\"",type="send-event"} 2`,
+		"# TYPE gobot_handler_duration_seconds histogram",
+		`gobot_handler_duration_seconds_bucket{room="b",handler="*gobot.replyHandler",le="0.01"} 0`,
+		`gobot_handler_duration_seconds_bucket{room="b",handler="*gobot.replyHandler",le="0.05"} 1`,
+		`gobot_handler_duration_seconds_bucket{room="b",handler="*gobot.replyHandler",le="+Inf"} 2`,
+		`gobot_handler_duration_seconds_sum{room="b",handler="*gobot.replyHandler"} 2.02`,
+		`gobot_handler_duration_seconds_count{room="b",handler="*gobot.replyHandler"} 2`,
+		`gobot_handler_errors_total{room="b",handler="*gobot.replyHandler"} 1`,
+		`gobot_ping_rtt_seconds_bucket{room="b",le="0.1"} 1`,
+	} {
+		c.Check(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %s", line))
+	}
+}
+
+func (s *MetricsSuite) TestRoom(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.Handlers = []Handler{&replyHandler{}}
+	go room.Run()
+
+	conn.incoming <- sendEvent("hi")
+	select {
+	case p := <-conn.outgoing:
+		c.Check(p.Type, Equals, proto.SendType)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for reply")
+	}
+
+	srv := httptest.NewServer(b.MetricsHandler())
+	defer srv.Close()
+	var out string
+	waitFor(c, func() bool {
+		resp, err := srv.Client().Get(srv.URL)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		out = string(body)
+		return strings.Contains(out, `gobot_packets_sent_total{room="test",type="send"} 1`)
+	})
+	for _, line := range []string{
+		`gobot_packets_received_total{room="test",type="send-event"} 1`,
+		`gobot_handler_duration_seconds_count{room="test",handler="*gobot.replyHandler"} 1`,
+		`gobot_outbound_queue_depth{room="test"} 0`,
+		`gobot_handler_queue_depth{room="test",handler="*gobot.replyHandler"} 0`,
+		`gobot_room_paused{room="test"} 0`,
+	} {
+		c.Check(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %s", line))
+	}
+}
@@ -0,0 +1,169 @@
+package gobot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// migrationsBucket is the reserved bucket recording the schema version of each
+// handler's data.
+const migrationsBucket = "_gobot_migrations"
+
+// Migration upgrades a handler's data to Version from the version before it.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *MigrationTx) error
+}
+
+// MigrationTx is the transaction a Migration runs in. Tx gives access to the
+// whole database; Bot and Rooms give access to the handler's stores (see
+// Bot.Store and Room.Store).
+type MigrationTx struct {
+	Tx   *bolt.Tx
+	name string
+}
+
+// Bot returns the handler's bot-wide store within the transaction.
+func (m *MigrationTx) Bot() (Bucket, error) {
+	b, err := nestedBucket(m.Tx, []string{storeBucket, m.name, "bot"}, true)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBucket{b: b, writable: true}, nil
+}
+
+// Rooms calls fn with the handler's store for each room that has one.
+func (m *MigrationTx) Rooms(fn func(room string, b Bucket) error) error {
+	rooms, err := nestedBucket(m.Tx, []string{storeBucket, m.name, "room"}, false)
+	if err != nil || rooms == nil {
+		return err
+	}
+	var names []string
+	err = rooms.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := fn(name, &boltBucket{b: rooms.Bucket([]byte(name)), writable: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationRegistry holds the migrations of each handler, in version order.
+type migrationRegistry struct {
+	mu         sync.Mutex
+	migrations map[string][]Migration
+}
+
+var migrations = &migrationRegistry{migrations: make(map[string][]Migration)}
+
+// RegisterMigrations registers the migrations for the named handler's data,
+// which NewBot applies in order to every database it opens, each in its own
+// transaction. Versions must be positive and increasing; each migration runs
+// once per database. The name should be the one the handler passes to Store.
+// RegisterMigrations is meant to be called from init functions and panics if
+// the handler already has migrations or the versions are out of order.
+func RegisterMigrations(name string, ms ...Migration) {
+	if err := migrations.register(name, ms); err != nil {
+		panic(err)
+	}
+}
+
+func (mr *migrationRegistry) register(name string, ms []Migration) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.migrations[name]; ok {
+		return fmt.Errorf("Migrations for %s registered twice", name)
+	}
+	last := 0
+	for _, m := range ms {
+		if m.Version <= last {
+			return fmt.Errorf("Migration %d for %s is out of order", m.Version, name)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("Migration %d for %s has no Up function", m.Version, name)
+		}
+		last = m.Version
+	}
+	mr.migrations[name] = append([]Migration(nil), ms...)
+	return nil
+}
+
+// run applies the pending migrations of every handler to db.
+func (mr *migrationRegistry) run(db *bolt.DB, logger *logrus.Logger) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	names := make([]string, 0, len(mr.migrations))
+	for name := range mr.migrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, m := range mr.migrations[name] {
+			if err := applyMigration(db, logger, name, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records its version in one transaction,
+// unless the recorded version is already at least as high.
+func applyMigration(db *bolt.DB, logger *logrus.Logger, name string, m Migration) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		versions, err := tx.CreateBucketIfNotExists([]byte(migrationsBucket))
+		if err != nil {
+			return err
+		}
+		var current int
+		if data := versions.Get([]byte(name)); data != nil {
+			if err := json.Unmarshal(data, &current); err != nil {
+				return fmt.Errorf("Bad schema version for %s: %s", name, err)
+			}
+		}
+		if current >= m.Version {
+			return nil
+		}
+		logger.Infof("Migrating %s to version %d: %s", name, m.Version, m.Description)
+		if err := m.Up(&MigrationTx{Tx: tx, name: name}); err != nil {
+			return fmt.Errorf("Migration %d for %s failed: %s", m.Version, name, err)
+		}
+		data, err := json.Marshal(m.Version)
+		if err != nil {
+			return err
+		}
+		return versions.Put([]byte(name), data)
+	})
+}
+
+// SchemaVersion returns the version of the named handler's data in the bot's
+// database, or zero if no migration has been applied.
+func (b *Bot) SchemaVersion(name string) (int, error) {
+	var version int
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket([]byte(migrationsBucket))
+		if versions == nil {
+			return nil
+		}
+		data := versions.Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &version)
+	})
+	return version, err
+}
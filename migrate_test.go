@@ -0,0 +1,155 @@
+package gobot
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	. "gopkg.in/check.v1"
+)
+
+type MigrateSuite struct {
+	dir string
+	db  *bolt.DB
+}
+
+var _ = Suite(&MigrateSuite{})
+
+func (s *MigrateSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "gobot-migrate")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.db, err = bolt.Open(filepath.Join(dir, "test.db"), 0666, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *MigrateSuite) TearDownTest(c *C) {
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+func newMigrationRegistry() *migrationRegistry {
+	return &migrationRegistry{migrations: make(map[string][]Migration)}
+}
+
+func (s *MigrateSuite) TestRunOnce(c *C) {
+	mr := newMigrationRegistry()
+	var runs []int
+	migration := func(version int) Migration {
+		return Migration{Version: version, Up: func(tx *MigrationTx) error {
+			runs = append(runs, version)
+			return nil
+		}}
+	}
+	c.Assert(mr.register("karma", []Migration{migration(1), migration(2)}), IsNil)
+	c.Assert(mr.run(s.db, logrus.New()), IsNil)
+	c.Assert(mr.run(s.db, logrus.New()), IsNil)
+	c.Check(runs, DeepEquals, []int{1, 2})
+
+	mr.migrations["karma"] = append(mr.migrations["karma"], migration(3))
+	c.Assert(mr.run(s.db, logrus.New()), IsNil)
+	c.Check(runs, DeepEquals, []int{1, 2, 3})
+}
+
+func (s *MigrateSuite) TestRegisterOrder(c *C) {
+	mr := newMigrationRegistry()
+	up := func(tx *MigrationTx) error { return nil }
+	c.Check(mr.register("a", []Migration{{Version: 2, Up: up}, {Version: 1, Up: up}}), NotNil)
+	c.Check(mr.register("b", []Migration{{Version: 0, Up: up}}), NotNil)
+	c.Check(mr.register("c", []Migration{{Version: 1}}), NotNil)
+	c.Check(mr.register("d", []Migration{{Version: 1, Up: up}}), IsNil)
+	c.Check(mr.register("d", []Migration{{Version: 1, Up: up}}), NotNil)
+}
+
+func (s *MigrateSuite) TestFailedMigrationRollsBack(c *C) {
+	mr := newMigrationRegistry()
+	c.Assert(mr.register("karma", []Migration{
+		{Version: 1, Up: func(tx *MigrationTx) error {
+			b, err := tx.Bot()
+			if err != nil {
+				return err
+			}
+			return b.Put("alice", 1)
+		}},
+		{Version: 2, Up: func(tx *MigrationTx) error {
+			b, err := tx.Bot()
+			if err != nil {
+				return err
+			}
+			if err := b.Put("bob", 2); err != nil {
+				return err
+			}
+			return errors.New("boom")
+		}},
+	}), IsNil)
+	c.Check(mr.run(s.db, logrus.New()), ErrorMatches, "Migration 2 for karma failed: boom")
+
+	store := NewBoltStorage(s.db).Store("karma", "bot")
+	var n int
+	ok, err := store.Get("alice", &n)
+	c.Check(ok, Equals, true)
+	c.Check(err, IsNil)
+	ok, err = store.Get("bob", &n)
+	c.Check(ok, Equals, false)
+	c.Check(err, IsNil)
+}
+
+func (s *MigrateSuite) TestRooms(c *C) {
+	storage := NewBoltStorage(s.db)
+	c.Assert(storage.Store("karma", "room", "one").Put("alice", 1), IsNil)
+	c.Assert(storage.Store("karma", "room", "two").Put("bob", 2), IsNil)
+
+	mr := newMigrationRegistry()
+	c.Assert(mr.register("karma", []Migration{{Version: 1, Up: func(tx *MigrationTx) error {
+		return tx.Rooms(func(room string, b Bucket) error {
+			counts := make(map[string]int)
+			err := b.ForEach("", func(key string, v Value) error {
+				var n int
+				err := v.Decode(&n)
+				counts[key] = n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for key, n := range counts {
+				if err := b.Put(key, n*10); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}}}), IsNil)
+	c.Assert(mr.run(s.db, logrus.New()), IsNil)
+
+	var n int
+	_, err := storage.Store("karma", "room", "one").Get("alice", &n)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 10)
+	_, err = storage.Store("karma", "room", "two").Get("bob", &n)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 20)
+}
+
+func (s *MigrateSuite) TestNewBot(c *C) {
+	var runs int
+	RegisterMigrations("migrate-test", Migration{Version: 3, Up: func(tx *MigrationTx) error {
+		runs++
+		return nil
+	}})
+	s.db.Close()
+	path := filepath.Join(s.dir, "test.db")
+	for i := 0; i < 2; i++ {
+		b, err := NewBot(BotConfig{Name: "test", DbPath: path})
+		c.Assert(err, IsNil)
+		version, err := b.SchemaVersion("migrate-test")
+		c.Check(err, IsNil)
+		c.Check(version, Equals, 3)
+		b.Stop()
+	}
+	c.Check(runs, Equals, 1)
+	s.db, _ = bolt.Open(path, 0666, nil)
+}
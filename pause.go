@@ -0,0 +1,72 @@
+package gobot
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"euphoria.io/heim/proto"
+)
+
+// ErrPaused is returned by SendText and Call when a message is not sent
+// because the room is paused.
+var ErrPaused = errors.New("room is paused")
+
+// ProtocolHandler is implemented by handlers for the euphoria bot protocol,
+// such as those answering !ping or !pause. They keep receiving packets while
+// the room is paused; all other handlers are suspended.
+type ProtocolHandler interface {
+	Handler
+	BotProtocol()
+}
+
+// Pause suspends the room's handlers other than ProtocolHandlers until Restore
+// is called. Packets received in the meantime are not passed to them. Ping
+// events are still answered and the room's roster and message cache are kept
+// up to date.
+//
+// While the room is paused, messages sent by the suspended handlers, such as
+// those sent from their Run methods, are dropped, and SendText and Call return
+// ErrPaused for them. Each handler is passed its own copy of the Room, which
+// tells them apart from the messages of ProtocolHandlers and of code holding
+// the Room itself, such as the admin API, which are still sent. The room stays
+// paused when it is restarted.
+func (r *Room) Pause() {
+	if atomic.SwapInt32(&r.paused, 1) == 0 {
+		r.Logger.Infof("Room '%s' paused", r.RoomName)
+	}
+}
+
+// Restore resumes the handlers suspended by Pause.
+func (r *Room) Restore() {
+	if atomic.SwapInt32(&r.paused, 0) == 1 {
+		r.Logger.Infof("Room '%s' restored", r.RoomName)
+	}
+}
+
+// Paused reports whether the room is paused.
+func (r *Room) Paused() bool {
+	return atomic.LoadInt32(&r.paused) == 1
+}
+
+// handlerRoom returns the Room passed to handler: r itself for a
+// ProtocolHandler, and otherwise a copy of r whose messages are held while the
+// room is paused.
+func (r *Room) handlerRoom(handler Handler) *Room {
+	if _, ok := handler.(ProtocolHandler); ok {
+		return r
+	}
+	hr := *r
+	hr.pausable = true
+	return &hr
+}
+
+// held reports whether a command must not be sent because the room is paused;
+// see Pause.
+func (r *Room) held(pType proto.PacketType) bool {
+	return pType == proto.SendType && r.pausable && r.Paused()
+}
+
+// carryPause keeps the pause of old, the room r replaces, in effect.
+func (r *Room) carryPause(old *Room) {
+	atomic.StoreInt32(&r.paused, atomic.LoadInt32(&old.paused))
+}
@@ -0,0 +1,134 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	. "gopkg.in/check.v1"
+)
+
+// protocolHandler is an eventHandler that keeps running while paused.
+type protocolHandler struct {
+	*eventHandler
+}
+
+func (h protocolHandler) BotProtocol() {}
+
+type PauseSuite struct{}
+
+var _ = Suite(&PauseSuite{})
+
+func (s *PauseSuite) TestPause(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	user := newEventHandler()
+	protocol := protocolHandler{newEventHandler()}
+	room.Handlers = []Handler{user, protocol}
+	go room.Run()
+
+	room.Pause()
+	c.Check(room.Paused(), Equals, true)
+	conn.incoming <- sendEvent("while paused")
+	expectEvent(c, protocol.events, "send while paused")
+
+	ping, _ := MakePacket(proto.PingEventType, proto.PingEvent{})
+	conn.incoming <- ping
+	select {
+	case p := <-conn.outgoing:
+		c.Check(p.Type, Equals, proto.PingReplyType)
+	case <-time.After(time.Second):
+		c.Fatal("ping was not answered while paused")
+	}
+
+	room.Restore()
+	c.Check(room.Paused(), Equals, false)
+	conn.incoming <- sendEvent("restored")
+	expectEvent(c, user.events, "send restored")
+	expectEvent(c, protocol.events, "send restored")
+	c.Check(user.events, HasLen, 0)
+}
+
+// roomHandler hands over the Room it is run with.
+type roomHandler struct {
+	BaseHandler
+	rooms chan *Room
+}
+
+func (h *roomHandler) Run(r *Room) {
+	h.rooms <- r
+}
+
+// protocolRoomHandler is a roomHandler that keeps running while paused.
+type protocolRoomHandler struct {
+	*roomHandler
+}
+
+func (h protocolRoomHandler) BotProtocol() {}
+
+func (s *PauseSuite) TestPausedSends(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	user := &roomHandler{rooms: make(chan *Room, 1)}
+	protocol := protocolRoomHandler{&roomHandler{rooms: make(chan *Room, 1)}}
+	room.Handlers = []Handler{user, protocol}
+	go room.Run()
+	userRoom, protocolRoom := <-user.rooms, <-protocol.rooms
+	room.Pause()
+
+	// Messages from suspended handlers are dropped, whatever they reply to.
+	_, err = userRoom.SendText(nil, "from Run")
+	c.Check(err, Equals, ErrPaused)
+	parent := snowflake.Snowflake(1)
+	_, err = userRoom.SendText(&parent, "late reply")
+	c.Check(err, Equals, ErrPaused)
+	_, err = userRoom.SendTextSync(nil, "from Run", time.Second)
+	c.Check(err, Equals, ErrPaused)
+
+	// Protocol handlers and code holding the room itself may still send.
+	_, err = protocolRoom.SendText(nil, "protocol message")
+	c.Check(err, IsNil)
+	expectSend(c, conn, "protocol message")
+	_, err = room.SendText(nil, "operator message")
+	c.Check(err, IsNil)
+	expectSend(c, conn, "operator message")
+
+	room.Restore()
+	_, err = userRoom.SendText(nil, "from Run")
+	c.Check(err, IsNil)
+	expectSend(c, conn, "from Run")
+}
+
+func expectSend(c *C, conn *MockConn, want string) {
+	select {
+	case p := <-conn.outgoing:
+		payload, err := p.Payload()
+		c.Assert(err, IsNil)
+		c.Check(payload.(*proto.SendCommand).Content, Equals, want)
+	case <-time.After(time.Second):
+		c.Errorf("timed out waiting for %q to be sent", want)
+	}
+}
+
+func (s *PauseSuite) TestPauseSurvivesRestart(c *C) {
+	b, conn, err := MockBotWithRestart(RestartAlways)
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	go b.RunAllRooms()
+	old, _ := b.Room("test")
+	waitFor(c, func() bool { return old.State() == RoomConnected })
+	old.Pause()
+	conn.incoming <- disconnectPacket()
+	waitFor(c, func() bool {
+		room, _ := b.Room("test")
+		return room != old && room.State() == RoomConnected
+	})
+	room, _ := b.Room("test")
+	c.Check(room.Paused(), Equals, true)
+	_, err = room.handlerRoom(newEventHandler()).SendText(nil, "from Run")
+	c.Check(err, Equals, ErrPaused)
+}
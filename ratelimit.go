@@ -0,0 +1,152 @@
+package gobot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+)
+
+const (
+	// maxSlowdown is the largest factor by which flood errors from the server
+	// can divide a limiter's rate.
+	maxSlowdown = 16
+
+	// slowdownRecovery is how long a limiter must go without a flood error
+	// before its slowdown is halved again.
+	slowdownRecovery = 30 * time.Second
+)
+
+// RateLimit configures a token bucket for outgoing packets: Rate packets per
+// second on average, in bursts of up to Burst packets. It can be set per room
+// in RoomConfig and per bot in BotConfig, in which case it is shared by all of
+// the bot's rooms. Ping replies are never limited.
+type RateLimit struct {
+	Rate  float64 `yaml:"Rate"`
+	Burst int     `yaml:"Burst,omitempty"`
+}
+
+// tokenBucket implements RateLimit. When the server reports flooding, the
+// bucket's rate is divided by a slowdown factor that doubles with every flood
+// error and halves again after each quiet slowdownRecovery period.
+type tokenBucket struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	slowdown  float64
+	lastFlood time.Time
+}
+
+// newTokenBucket returns a full bucket for the given limit, or nil if the limit
+// is not set. A nil *tokenBucket never limits.
+func newTokenBucket(limit *RateLimit) *tokenBucket {
+	if limit == nil || limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:     limit.Rate,
+		burst:    burst,
+		tokens:   burst,
+		last:     time.Now(),
+		slowdown: 1,
+	}
+}
+
+// reserve takes a token if one is available at the given time and returns
+// zero. Otherwise it returns how long to wait before trying again.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	for tb.slowdown > 1 && now.Sub(tb.lastFlood) > slowdownRecovery {
+		tb.slowdown /= 2
+		tb.lastFlood = tb.lastFlood.Add(slowdownRecovery)
+	}
+	rate := tb.rate / tb.slowdown
+	tb.tokens += now.Sub(tb.last).Seconds() * rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / rate * float64(time.Second))
+}
+
+// flooded slows the bucket down after the server complained about flooding.
+func (tb *tokenBucket) flooded(now time.Time) {
+	if tb == nil {
+		return
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.slowdown *= 2
+	if tb.slowdown > maxSlowdown {
+		tb.slowdown = maxSlowdown
+	}
+	tb.tokens = 0
+	tb.lastFlood = now
+}
+
+// isFloodError reports whether an error returned by the server indicates that
+// the bot is sending too quickly.
+func isFloodError(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range []string{"flood", "rate limit", "too many", "throttl", "slow down"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForToken blocks until both the room's and the bot's limiters allow
+// another packet to be sent, sending any priority packets, such as ping
+// replies, that arrive in the meantime. It returns false if the room's context finished first.
+func (r *Room) waitForToken() bool {
+	for _, limiter := range []*tokenBucket{r.limiter, r.botLimiter} {
+		for {
+			delay := limiter.reserve(time.Now())
+			if delay == 0 {
+				break
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-r.Ctx.Done():
+				timer.Stop()
+				return false
+			case msg := <-r.priority:
+				timer.Stop()
+				if !r.send(msg) {
+					return false
+				}
+			case <-timer.C:
+			}
+		}
+	}
+	return true
+}
+
+// checkFlood slows down the room's and the bot's limiters if the packet is an
+// error reply about flooding, and reports whether it was.
+func (r *Room) checkFlood(p *proto.Packet) bool {
+	if p.Error == "" || !isFloodError(p.Error) {
+		return false
+	}
+	r.Logger.Warningf("Server reports flooding in %s: %s", p.Type, p.Error)
+	now := time.Now()
+	r.limiter.flooded(now)
+	r.botLimiter.flooded(now)
+	return true
+}
@@ -0,0 +1,113 @@
+package gobot
+
+import (
+	"encoding/json"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestTokenBucket(c *C) {
+	tb := newTokenBucket(&RateLimit{Rate: 2, Burst: 2})
+	now := tb.last
+	c.Check(tb.reserve(now), Equals, time.Duration(0))
+	c.Check(tb.reserve(now), Equals, time.Duration(0))
+	c.Check(tb.reserve(now), Equals, 500*time.Millisecond)
+	c.Check(tb.reserve(now.Add(500*time.Millisecond)), Equals, time.Duration(0))
+	c.Check(tb.reserve(now.Add(10*time.Second)), Equals, time.Duration(0))
+	c.Check(tb.reserve(now.Add(10*time.Second)), Equals, time.Duration(0))
+	c.Check(tb.reserve(now.Add(10*time.Second)), Equals, 500*time.Millisecond)
+}
+
+func (s *RateLimitSuite) TestNilBucket(c *C) {
+	c.Check(newTokenBucket(nil), IsNil)
+	c.Check(newTokenBucket(&RateLimit{}), IsNil)
+	var tb *tokenBucket
+	c.Check(tb.reserve(time.Now()), Equals, time.Duration(0))
+	tb.flooded(time.Now())
+}
+
+func (s *RateLimitSuite) TestFlooded(c *C) {
+	tb := newTokenBucket(&RateLimit{Rate: 1, Burst: 1})
+	now := tb.last
+	tb.flooded(now)
+	c.Check(tb.reserve(now), Equals, 2*time.Second)
+	tb.flooded(now)
+	c.Check(tb.reserve(now), Equals, 4*time.Second)
+	later := now.Add(slowdownRecovery + time.Second)
+	c.Check(tb.reserve(later), Equals, time.Duration(0))
+	c.Check(tb.slowdown, Equals, float64(2))
+}
+
+func (s *RateLimitSuite) TestIsFloodError(c *C) {
+	c.Check(isFloodError("you are flooding the room"), Equals, true)
+	c.Check(isFloodError("Too many requests"), Equals, true)
+	c.Check(isFloodError("nick too long"), Equals, false)
+}
+
+func (s *RateLimitSuite) TestPingSkipsLimiter(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.limiter = newTokenBucket(&RateLimit{Rate: 0.5, Burst: 1})
+	go room.Run()
+	for i := 0; i < 3; i++ {
+		room.SendText(nil, "spam")
+	}
+	c.Check((<-conn.outgoing).Type, Equals, proto.SendType)
+
+	ping := &proto.Packet{Type: proto.PingEventType}
+	data, _ := json.Marshal(proto.PingEvent{UnixTime: proto.Time(time.Now())})
+	ping.Data.UnmarshalJSON(data)
+	conn.incoming <- ping
+	select {
+	case msg := <-conn.outgoing:
+		c.Check(msg.Type, Equals, proto.PingReplyType)
+	case <-time.After(time.Second):
+		c.Fatal("ping reply was held back by the rate limiter")
+	}
+}
+
+func (s *RateLimitSuite) TestMeasurePingSkipsLimiter(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.limiter = newTokenBucket(&RateLimit{Rate: 0.5, Burst: 1})
+	go room.Run()
+	for i := 0; i < 3; i++ {
+		room.SendText(nil, "spam")
+	}
+	c.Check((<-conn.outgoing).Type, Equals, proto.SendType)
+
+	go room.measurePing()
+	select {
+	case msg := <-conn.outgoing:
+		c.Check(msg.Type, Equals, proto.PingType)
+	case <-time.After(time.Second):
+		c.Fatal("ping was held back by the rate limiter")
+	}
+}
+
+func (s *RateLimitSuite) TestFloodErrorNotFatal(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	room.limiter = newTokenBucket(&RateLimit{Rate: 10, Burst: 1})
+	go room.Run()
+	room.SendText(nil, "spam")
+	msg := <-conn.outgoing
+	conn.incoming <- &proto.Packet{ID: msg.ID, Type: proto.SendReplyType, Error: "flooding"}
+	time.Sleep(50 * time.Millisecond)
+	c.Check(room.Ctx.Alive(), Equals, true)
+	room.limiter.mu.Lock()
+	c.Check(room.limiter.slowdown, Equals, float64(2))
+	room.limiter.mu.Unlock()
+}
@@ -0,0 +1,105 @@
+package gobot
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"euphoria.io/scope"
+)
+
+// ReconnectPolicy decides whether and when a Connection retries after a failed
+// attempt to connect to euphoria.
+type ReconnectPolicy interface {
+	// Delay returns how long to wait before the given retry, counting from 1,
+	// and false if no more retries should be made.
+	Delay(retry int) (time.Duration, bool)
+}
+
+const (
+	// DefaultReconnectBackoff is the first delay of an ExponentialBackoff
+	// that does not set Initial.
+	DefaultReconnectBackoff = 5 * time.Second
+
+	// MaxReconnectBackoff caps the delay of an ExponentialBackoff that does
+	// not set Max.
+	MaxReconnectBackoff = time.Hour
+)
+
+// ExponentialBackoff is a ReconnectPolicy whose delay starts at Initial and is
+// multiplied by Multiplier after every retry, up to Max. Jitter is the
+// fraction, between 0 and 1, by which each delay is randomly lengthened or
+// shortened. A MaxRetries of zero retries until the room's context is finished.
+// Initial defaults to DefaultReconnectBackoff and Max to MaxReconnectBackoff.
+type ExponentialBackoff struct {
+	Initial    time.Duration `yaml:"Initial"`
+	Max        time.Duration `yaml:"Max"`
+	Multiplier float64       `yaml:"Multiplier,omitempty"`
+	Jitter     float64       `yaml:"Jitter,omitempty"`
+	MaxRetries int           `yaml:"MaxRetries,omitempty"`
+}
+
+// DefaultReconnectPolicy is used by rooms that do not set a ReconnectPolicy in
+// their RoomConfig. It gives up after five retries spread over about a minute
+// and a quarter.
+var DefaultReconnectPolicy ReconnectPolicy = &ExponentialBackoff{
+	Initial:    DefaultReconnectBackoff,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+	MaxRetries: 5,
+}
+
+// Delay satisfies the ReconnectPolicy interface.
+func (e *ExponentialBackoff) Delay(retry int) (time.Duration, bool) {
+	if e.MaxRetries > 0 && retry > e.MaxRetries {
+		return 0, false
+	}
+	multiplier := e.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	initial := e.Initial
+	if initial <= 0 {
+		initial = DefaultReconnectBackoff
+	}
+	max := e.Max
+	if max <= 0 {
+		max = MaxReconnectBackoff
+	}
+	// The product overflows to +Inf for large retries, which the comparison
+	// clamps like any other delay above max.
+	delay := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if e.Jitter > 0 {
+		delay += (rand.Float64()*2 - 1) * e.Jitter * delay
+	}
+	return time.Duration(delay), true
+}
+
+// reconnectPolicy picks the policy for a room: an explicit ReconnectPolicy,
+// then the Reconnect settings from YAML, then DefaultReconnectPolicy.
+func (cfg RoomConfig) reconnectPolicy() ReconnectPolicy {
+	if cfg.ReconnectPolicy != nil {
+		return cfg.ReconnectPolicy
+	}
+	if cfg.Reconnect != nil {
+		return cfg.Reconnect
+	}
+	return DefaultReconnectPolicy
+}
+
+// sleepContext waits for the given duration and returns early with the
+// context's error if the context is finished first.
+func sleepContext(ctx scope.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
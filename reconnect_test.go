@@ -0,0 +1,81 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/scope"
+	. "gopkg.in/check.v1"
+)
+
+type ReconnectSuite struct{}
+
+var _ = Suite(&ReconnectSuite{})
+
+func (s *ReconnectSuite) TestExponentialBackoff(c *C) {
+	e := &ExponentialBackoff{
+		Initial:    time.Second,
+		Max:        5 * time.Second,
+		Multiplier: 2,
+		MaxRetries: 4,
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		delay, ok := e.Delay(i + 1)
+		c.Check(ok, Equals, true)
+		c.Check(delay, Equals, want)
+	}
+	_, ok := e.Delay(5)
+	c.Check(ok, Equals, false)
+}
+
+func (s *ReconnectSuite) TestUnlimitedRetries(c *C) {
+	e := &ExponentialBackoff{Initial: time.Second, Max: time.Minute}
+	delay, ok := e.Delay(1000)
+	c.Check(ok, Equals, true)
+	c.Check(delay, Equals, time.Minute)
+}
+
+func (s *ReconnectSuite) TestDefaultInitial(c *C) {
+	e := &ExponentialBackoff{Max: time.Minute, MaxRetries: 3}
+	delay, ok := e.Delay(1)
+	c.Check(ok, Equals, true)
+	c.Check(delay, Equals, DefaultReconnectBackoff)
+}
+
+func (s *ReconnectSuite) TestDefaultMax(c *C) {
+	e := &ExponentialBackoff{Initial: time.Second}
+	for _, retry := range []int{30, 100, 10000} {
+		delay, ok := e.Delay(retry)
+		c.Check(ok, Equals, true)
+		c.Check(delay, Equals, MaxReconnectBackoff)
+	}
+}
+
+func (s *ReconnectSuite) TestJitter(c *C) {
+	e := &ExponentialBackoff{Initial: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay, _ := e.Delay(1)
+		c.Check(delay >= 5*time.Second && delay <= 15*time.Second, Equals, true)
+	}
+}
+
+func (s *ReconnectSuite) TestPolicyPrecedence(c *C) {
+	c.Check(RoomConfig{}.reconnectPolicy(), Equals, DefaultReconnectPolicy)
+	fromYAML := &ExponentialBackoff{Initial: time.Second}
+	c.Check(RoomConfig{Reconnect: fromYAML}.reconnectPolicy(), Equals, ReconnectPolicy(fromYAML))
+	explicit := &ExponentialBackoff{Initial: time.Minute}
+	cfg := RoomConfig{Reconnect: fromYAML, ReconnectPolicy: explicit}
+	c.Check(cfg.reconnectPolicy(), Equals, ReconnectPolicy(explicit))
+}
+
+func (s *ReconnectSuite) TestSleepCancelled(c *C) {
+	ctx := scope.New()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ctx.Cancel()
+	}()
+	start := time.Now()
+	err := sleepContext(ctx, time.Minute)
+	c.Check(err, NotNil)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+}
@@ -0,0 +1,146 @@
+package gobot
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+)
+
+// Presence describes a session in a room other than the bot's own.
+type Presence struct {
+	SessionID string
+
+	// AgentID is the identity of the session's user, such as
+	// "agent:abcdef" or "account:123456".
+	AgentID string
+
+	Nick string
+
+	// Joined is when the session's join-event was received, or when the
+	// snapshot listing it was received if it was already present.
+	Joined time.Time
+}
+
+// roster tracks the sessions present in a room. The zero value is an empty
+// roster.
+type roster struct {
+	mu       sync.RWMutex
+	sessions map[string]Presence
+}
+
+func presenceOf(sv proto.SessionView, joined time.Time) Presence {
+	return Presence{
+		SessionID: sv.SessionID,
+		AgentID:   string(sv.ID),
+		Nick:      sv.Name,
+		Joined:    joined,
+	}
+}
+
+// reset replaces the roster with the sessions in a snapshot listing.
+func (rs *roster) reset(listing []proto.SessionView, now time.Time) {
+	sessions := make(map[string]Presence, len(listing))
+	for _, sv := range listing {
+		sessions[sv.SessionID] = presenceOf(sv, now)
+	}
+	rs.mu.Lock()
+	rs.sessions = sessions
+	rs.mu.Unlock()
+}
+
+func (rs *roster) join(sv proto.SessionView, now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.sessions == nil {
+		rs.sessions = make(map[string]Presence)
+	}
+	rs.sessions[sv.SessionID] = presenceOf(sv, now)
+}
+
+func (rs *roster) part(sessionID string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.sessions, sessionID)
+}
+
+func (rs *roster) nick(sessionID, nick string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if p, ok := rs.sessions[sessionID]; ok {
+		p.Nick = nick
+		rs.sessions[sessionID] = p
+	}
+}
+
+// list returns the sessions in the order they joined.
+func (rs *roster) list() []Presence {
+	rs.mu.RLock()
+	list := make([]Presence, 0, len(rs.sessions))
+	for _, p := range rs.sessions {
+		list = append(list, p)
+	}
+	rs.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Joined.Equal(list[j].Joined) {
+			return list[i].Joined.Before(list[j].Joined)
+		}
+		return list[i].SessionID < list[j].SessionID
+	})
+	return list
+}
+
+// trackPresence updates the room's roster from snapshot, join, part and nick
+// events. It runs in the dispatcher before the event reaches the handlers.
+func (r *Room) trackPresence(ev *Event) {
+	switch ev.Type() {
+	case proto.SnapshotEventType, proto.JoinEventType, proto.PartEventType, proto.NickEventType:
+	default:
+		return
+	}
+	payload, err := ev.Payload()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	switch e := payload.(type) {
+	case *proto.SnapshotEvent:
+		r.roster.reset(e.Listing, now)
+	case *proto.PresenceEvent:
+		if ev.Type() == proto.JoinEventType {
+			r.roster.join(proto.SessionView(*e), now)
+		} else {
+			r.roster.part(e.SessionID)
+		}
+	case *proto.NickEvent:
+		r.roster.nick(e.SessionID, e.To)
+	}
+}
+
+// Who returns the sessions present in the room, not including the bot's own,
+// in the order they joined. The roster is rebuilt from the snapshot the server
+// sends each time the room connects.
+func (r *Room) Who() []Presence {
+	return r.roster.list()
+}
+
+// SessionByNick returns the earliest joined session using the given nick. Like
+// MentionsNick, it ignores whitespace and differences in case.
+func (r *Room) SessionByNick(nick string) (Presence, bool) {
+	want := normalizeNick(nick)
+	for _, p := range r.roster.list() {
+		if normalizeNick(p.Nick) == want {
+			return p, true
+		}
+	}
+	return Presence{}, false
+}
+
+// IsPresent reports whether the session with the given ID is in the room.
+func (r *Room) IsPresent(sessionID string) bool {
+	r.roster.mu.RLock()
+	defer r.roster.mu.RUnlock()
+	_, ok := r.roster.sessions[sessionID]
+	return ok
+}
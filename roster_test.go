@@ -0,0 +1,72 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+func session(id, agent, nick string) proto.SessionView {
+	return proto.SessionView{
+		IdentityView: proto.IdentityView{ID: proto.UserID(agent), Name: nick},
+		SessionID:    id,
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(c *C, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type RosterSuite struct{}
+
+var _ = Suite(&RosterSuite{})
+
+func (s *RosterSuite) TestRoster(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	go room.Run()
+
+	snapshot, _ := MakePacket(proto.SnapshotEventType, proto.SnapshotEvent{
+		Listing: proto.Listing{session("s1", "agent:a", "alice"), session("s2", "agent:b", "bob")},
+	})
+	conn.incoming <- snapshot
+	waitFor(c, func() bool { return len(room.Who()) == 2 })
+	c.Check(room.IsPresent("s1"), Equals, true)
+
+	join, _ := MakePacket(proto.JoinEventType, proto.PresenceEvent(session("s3", "account:c", "Carol Ann")))
+	conn.incoming <- join
+	waitFor(c, func() bool { return room.IsPresent("s3") })
+	who := room.Who()
+	c.Assert(who, HasLen, 3)
+	c.Check(who[2].SessionID, Equals, "s3")
+	c.Check(who[2].AgentID, Equals, "account:c")
+	c.Check(who[2].Joined.IsZero(), Equals, false)
+
+	p, ok := room.SessionByNick("carolann")
+	c.Check(ok, Equals, true)
+	c.Check(p.SessionID, Equals, "s3")
+
+	nick, _ := MakePacket(proto.NickEventType, proto.NickEvent{SessionID: "s1", From: "alice", To: "alicia"})
+	conn.incoming <- nick
+	waitFor(c, func() bool { _, ok := room.SessionByNick("alicia"); return ok })
+	_, ok = room.SessionByNick("alice")
+	c.Check(ok, Equals, false)
+
+	part, _ := MakePacket(proto.PartEventType, proto.PresenceEvent(session("s2", "agent:b", "bob")))
+	conn.incoming <- part
+	waitFor(c, func() bool { return !room.IsPresent("s2") })
+	c.Check(room.Who(), HasLen, 2)
+
+	conn.incoming <- snapshot
+	waitFor(c, func() bool { return room.IsPresent("s2") && !room.IsPresent("s3") })
+}
@@ -0,0 +1,183 @@
+package gobot
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"euphoria.io/heim/proto"
+)
+
+// Command is a bot command parsed from the content of a message, such as
+// "!roll @GoBot 2d6 fire".
+type Command struct {
+	// Name is the command without the leading "!", e.g. "roll".
+	Name string
+
+	// Mention is the nick mentioned directly after the command, without the
+	// "@", or the empty string if there is none.
+	Mention string
+
+	// Args are the whitespace-separated words following the name and mention.
+	Args []string
+
+	// Text is everything following the name and mention with surrounding
+	// whitespace removed, e.g. "2d6 fire".
+	Text string
+}
+
+// ParseCommand parses content of the form "!name [@mention] [args...]". It
+// returns false if the content is not a command.
+func ParseCommand(content string) (*Command, bool) {
+	content = strings.TrimSpace(content)
+	fields := strings.Fields(content)
+	if len(fields) == 0 || len(fields[0]) < 2 || fields[0][0] != '!' {
+		return nil, false
+	}
+	cmd := &Command{Name: fields[0][1:]}
+	text := strings.TrimSpace(content[len(fields[0]):])
+	args := fields[1:]
+	if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '@' {
+		cmd.Mention = args[0][1:]
+		text = strings.TrimSpace(text[len(args[0]):])
+		args = args[1:]
+	}
+	cmd.Args = args
+	cmd.Text = text
+	return cmd, true
+}
+
+// MentionsNick reports whether a mention refers to the given nick. Like
+// euphoria, it ignores whitespace in the nick and differences in case.
+func MentionsNick(mention, nick string) bool {
+	return mention != "" && normalizeNick(mention) == normalizeNick(nick)
+}
+
+func normalizeNick(nick string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, nick))
+}
+
+// CommandFunc is called by a Router with the parsed command and the send-event
+// it came from.
+type CommandFunc func(r *Room, cmd *Command, msg *proto.SendEvent) error
+
+// Route describes a command. A command that mentions another nick is never
+// matched, so that "!ping @OtherBot" is left to OtherBot. If RequireMention is
+// set, the command must mention the bot, as in "!kill @GoBot". Commands with
+// fewer than MinArgs arguments are not matched.
+type Route struct {
+	Name           string
+	Aliases        []string
+	RequireMention bool
+	MinArgs        int
+	Func           CommandFunc
+}
+
+// Match parses content and reports whether it is a command for this route
+// addressed to a bot with the given name.
+func (rt *Route) Match(botName, content string) (*Command, bool) {
+	cmd, ok := ParseCommand(content)
+	if !ok || !rt.hasName(cmd.Name) {
+		return nil, false
+	}
+	if !rt.accepts(botName, cmd) {
+		return nil, false
+	}
+	return cmd, true
+}
+
+func (rt *Route) hasName(name string) bool {
+	if strings.EqualFold(name, rt.Name) {
+		return true
+	}
+	for _, alias := range rt.Aliases {
+		if strings.EqualFold(name, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *Route) accepts(botName string, cmd *Command) bool {
+	if cmd.Mention != "" && !MentionsNick(cmd.Mention, botName) {
+		return false
+	}
+	if rt.RequireMention && cmd.Mention == "" {
+		return false
+	}
+	return len(cmd.Args) >= rt.MinArgs
+}
+
+// Router is a Handler that dispatches commands in send-events to the Route
+// registered for the command's name or one of its aliases.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]*Route
+}
+
+// NewRouter returns a Router with no routes.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]*Route)}
+}
+
+// Add registers a route under its name and aliases, replacing any route
+// previously registered under the same names.
+func (rt *Router) Add(route Route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes[strings.ToLower(route.Name)] = &route
+	for _, alias := range route.Aliases {
+		rt.routes[strings.ToLower(alias)] = &route
+	}
+}
+
+// Handle registers fn for the named command and its aliases.
+func (rt *Router) Handle(name string, fn CommandFunc, aliases ...string) {
+	rt.Add(Route{Name: name, Aliases: aliases, Func: fn})
+}
+
+// Route returns the route and parsed command matching content for a bot with
+// the given name, if any.
+func (rt *Router) Route(botName, content string) (*Route, *Command, bool) {
+	cmd, ok := ParseCommand(content)
+	if !ok {
+		return nil, nil, false
+	}
+	rt.mu.RLock()
+	route, ok := rt.routes[strings.ToLower(cmd.Name)]
+	rt.mu.RUnlock()
+	if !ok || !route.accepts(botName, cmd) {
+		return nil, nil, false
+	}
+	return route, cmd, true
+}
+
+// HandleIncoming is a no-op; commands are routed by OnSend.
+func (rt *Router) HandleIncoming(r *Room, p *proto.Packet) (*proto.Packet, error) {
+	return nil, nil
+}
+
+// OnSend calls the function of the route matching the message, if any.
+func (rt *Router) OnSend(r *Room, msg *proto.SendEvent) error {
+	route, cmd, ok := rt.Route(r.BotName, msg.Content)
+	if !ok || route.Func == nil {
+		return nil
+	}
+	r.Logger.Debugf("Routing command !%s", cmd.Name)
+	return route.Func(r, cmd, msg)
+}
+
+// Run is a no-op.
+func (rt *Router) Run(r *Room) {
+	return
+}
+
+// Stop is a no-op.
+func (rt *Router) Stop(r *Room) {
+	return
+}
@@ -0,0 +1,111 @@
+package gobot
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+type RouterSuite struct{}
+
+var _ = Suite(&RouterSuite{})
+
+func (s *RouterSuite) TestParseCommand(c *C) {
+	cmd, ok := ParseCommand("  !roll @GoBot 2d6   fire ")
+	c.Assert(ok, Equals, true)
+	c.Check(cmd.Name, Equals, "roll")
+	c.Check(cmd.Mention, Equals, "GoBot")
+	c.Check(cmd.Args, DeepEquals, []string{"2d6", "fire"})
+	c.Check(cmd.Text, Equals, "2d6   fire")
+
+	cmd, ok = ParseCommand("!ping")
+	c.Assert(ok, Equals, true)
+	c.Check(cmd.Name, Equals, "ping")
+	c.Check(cmd.Mention, Equals, "")
+	c.Check(len(cmd.Args), Equals, 0)
+
+	for _, content := range []string{"", "!", "ping", "hello !ping", "! ping"} {
+		_, ok = ParseCommand(content)
+		c.Check(ok, Equals, false, Commentf("content %q", content))
+	}
+}
+
+func (s *RouterSuite) TestMentionsNick(c *C) {
+	c.Check(MentionsNick("GoBot", "GoBot"), Equals, true)
+	c.Check(MentionsNick("gobot", "Go Bot"), Equals, true)
+	c.Check(MentionsNick("GoBot2", "GoBot"), Equals, false)
+	c.Check(MentionsNick("", "GoBot"), Equals, false)
+}
+
+func (s *RouterSuite) TestRouteMatch(c *C) {
+	route := &Route{Name: "ping", Aliases: []string{"p"}}
+	matches := map[string]bool{
+		"!ping":             true,
+		"!PING":             true,
+		"!p":                true,
+		"!ping @GoBot":      true,
+		"!ping @gobot hi":   true,
+		"!pingpong":         false,
+		"!ping @OtherBot":   false,
+		"ping":              false,
+		"something !ping":   false,
+		"!pong @GoBot ping": false,
+	}
+	for content, want := range matches {
+		_, ok := route.Match("GoBot", content)
+		c.Check(ok, Equals, want, Commentf("content %q", content))
+	}
+
+	route = &Route{Name: "kill", RequireMention: true}
+	_, ok := route.Match("GoBot", "!kill")
+	c.Check(ok, Equals, false)
+	_, ok = route.Match("GoBot", "!kill @GoBot")
+	c.Check(ok, Equals, true)
+
+	route = &Route{Name: "roll", MinArgs: 1}
+	_, ok = route.Match("GoBot", "!roll")
+	c.Check(ok, Equals, false)
+	_, ok = route.Match("GoBot", "!roll 2d6")
+	c.Check(ok, Equals, true)
+}
+
+func (s *RouterSuite) TestRouterDispatch(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Check(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	called := make(chan *Command, 1)
+	router := NewRouter()
+	router.Handle("echo", func(r *Room, cmd *Command, msg *proto.SendEvent) error {
+		called <- cmd
+		_, err := r.SendText(&msg.ID, cmd.Text)
+		return err
+	}, "say")
+	room.Handlers = []Handler{router}
+	go room.Run()
+
+	packet, _ := MakePacket(proto.SendEventType, proto.SendEvent{Content: "!echo"})
+	conn.incoming <- packet
+	packet, _ = MakePacket(proto.SendEventType, proto.SendEvent{Content: "!say @test hello there"})
+	conn.incoming <- packet
+	select {
+	case cmd := <-called:
+		c.Check(cmd.Name, Equals, "echo")
+		c.Check(cmd.Text, Equals, "")
+	case <-time.After(time.Second):
+		c.Fatal("command was not routed")
+	}
+	<-conn.outgoing
+	select {
+	case cmd := <-called:
+		c.Check(cmd.Name, Equals, "say")
+		c.Check(cmd.Text, Equals, "hello there")
+	case <-time.After(time.Second):
+		c.Fatal("alias was not routed")
+	}
+	msg := <-conn.outgoing
+	reply, err := msg.Payload()
+	c.Check(err, IsNil)
+	c.Check(reply.(*proto.SendCommand).Content, Equals, "hello there")
+}
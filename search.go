@@ -0,0 +1,293 @@
+package gobot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/boltdb/bolt"
+)
+
+// searchBucket is the reserved bucket holding the inverted index of each
+// archived room, mapping term, 0, message ID to nothing.
+const searchBucket = "_gobot_search"
+
+// searchDate is the layout of dates in search queries.
+const searchDate = "2006-01-02"
+
+var errEmptySearch = errors.New("Empty search")
+
+// SearchQuery selects archived messages by their content. Messages must
+// contain every term and every phrase, ignoring case and punctuation. From,
+// Since and Until filter messages like the Sender, Since and Until fields of
+// ArchiveQuery. If Filter is set, only messages for which it returns true are
+// returned. If Limit is positive, at most Limit messages are returned.
+type SearchQuery struct {
+	Terms   []string
+	Phrases []string
+	From    string
+	Since   time.Time
+	Until   time.Time
+	Filter  func(msg *proto.Message) bool
+	Limit   int
+}
+
+// ParseSearch parses a search as typed by a user, such as
+//
+//	"that link" from:alice since:2015-06-01 example.com
+//
+// Quoted text is a phrase, as are words joined by punctuation. from:nick
+// matches the sender. since:date and until:date take dates of the form
+// YYYY-MM-DD in UTC and include the days given. Other words are terms.
+func ParseSearch(text string) (SearchQuery, error) {
+	var q SearchQuery
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+		var word string
+		if text[0] == '"' {
+			end := strings.IndexByte(text[1:], '"')
+			if end < 0 {
+				word, text = text[1:], ""
+			} else {
+				word, text = text[1:end+1], text[end+2:]
+			}
+			q.addPhrase(word)
+			continue
+		}
+		if end := strings.IndexFunc(text, unicode.IsSpace); end < 0 {
+			word, text = text, ""
+		} else {
+			word, text = text[:end], text[end:]
+		}
+		switch {
+		case strings.HasPrefix(word, "from:") && len(word) > len("from:"):
+			q.From = word[len("from:"):]
+		case strings.HasPrefix(word, "since:"):
+			t, err := parseSearchDate(word[len("since:"):])
+			if err != nil {
+				return q, err
+			}
+			q.Since = t
+		case strings.HasPrefix(word, "until:"):
+			t, err := parseSearchDate(word[len("until:"):])
+			if err != nil {
+				return q, err
+			}
+			q.Until = t.AddDate(0, 0, 1)
+		default:
+			q.addPhrase(word)
+		}
+	}
+	if q.empty() {
+		return q, errEmptySearch
+	}
+	return q, nil
+}
+
+func parseSearchDate(s string) (time.Time, error) {
+	t, err := time.Parse(searchDate, s)
+	if err != nil {
+		return t, fmt.Errorf("Invalid date %q, expected YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+// addPhrase adds text as a term if it is a single word and as a phrase if it
+// has several.
+func (q *SearchQuery) addPhrase(text string) {
+	switch terms := searchTerms(text); len(terms) {
+	case 0:
+	case 1:
+		q.Terms = append(q.Terms, terms[0])
+	default:
+		q.Phrases = append(q.Phrases, strings.Join(terms, " "))
+	}
+}
+
+// words returns the distinct terms of q and its phrases.
+func (q *SearchQuery) words() []string {
+	seen := make(map[string]bool)
+	var words []string
+	add := func(terms []string) {
+		for _, term := range terms {
+			if !seen[term] {
+				seen[term] = true
+				words = append(words, term)
+			}
+		}
+	}
+	for _, term := range q.Terms {
+		add(searchTerms(term))
+	}
+	for _, phrase := range q.Phrases {
+		add(searchTerms(phrase))
+	}
+	return words
+}
+
+func (q *SearchQuery) empty() bool {
+	return len(q.words()) == 0 && q.From == "" && q.Since.IsZero() && q.Until.IsZero()
+}
+
+// matches reports whether msg satisfies all of the conditions of q other than
+// its terms, which are checked by the index.
+func (q *SearchQuery) matches(msg *proto.Message) bool {
+	aq := ArchiveQuery{Since: q.Since, Until: q.Until, Sender: q.From}
+	if isDeleted(msg) || !aq.matches(msg) {
+		return false
+	}
+	if len(q.Phrases) > 0 {
+		content := " " + strings.Join(searchTerms(msg.Content), " ") + " "
+		for _, phrase := range q.Phrases {
+			if !strings.Contains(content, " "+strings.Join(searchTerms(phrase), " ")+" ") {
+				return false
+			}
+		}
+	}
+	return q.Filter == nil || q.Filter(msg)
+}
+
+// Search returns the archived messages matching q, most recent first. The
+// index is kept up to date as messages are archived, so only messages received
+// while the room had RoomConfig.Search set are found.
+func (a *Archive) Search(q SearchQuery) ([]proto.Message, error) {
+	if q.empty() {
+		return nil, errEmptySearch
+	}
+	words := q.words()
+	if len(words) == 0 {
+		return a.searchArchive(q)
+	}
+	var results []proto.Message
+	err := a.db.View(func(tx *bolt.Tx) error {
+		index, err := nestedBucket(tx, []string{searchBucket, a.room}, false)
+		if err != nil || index == nil {
+			return err
+		}
+		archive, err := nestedBucket(tx, []string{archiveBucket, a.room}, false)
+		if err != nil || archive == nil {
+			return err
+		}
+		var ids map[snowflake.Snowflake]bool
+		for _, word := range words {
+			ids = postings(index, word, ids)
+			if len(ids) == 0 {
+				return nil
+			}
+		}
+		sorted := make([]snowflake.Snowflake, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Sort(sort.Reverse(snowflakes(sorted)))
+		messages := archive.Bucket(archiveMessages)
+		for _, id := range sorted {
+			data := messages.Get(idKey(id))
+			if data == nil {
+				continue
+			}
+			var msg proto.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return err
+			}
+			if !q.matches(&msg) {
+				continue
+			}
+			results = append(results, msg)
+			if q.Limit > 0 && len(results) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// searchArchive answers a search without terms from the archive's indexes.
+func (a *Archive) searchArchive(q SearchQuery) ([]proto.Message, error) {
+	msgs, err := a.Messages(ArchiveQuery{Since: q.Since, Until: q.Until, Sender: q.From})
+	if err != nil {
+		return nil, err
+	}
+	var results []proto.Message
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if !q.matches(&msgs[i]) {
+			continue
+		}
+		results = append(results, msgs[i])
+		if q.Limit > 0 && len(results) >= q.Limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// postings returns the IDs of the messages containing word, restricted to
+// those in within if it is not nil.
+func postings(index *bolt.Bucket, word string, within map[snowflake.Snowflake]bool) map[snowflake.Snowflake]bool {
+	ids := make(map[snowflake.Snowflake]bool)
+	prefix := termPrefix(word)
+	c := index.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		id := keyID(k[len(prefix):])
+		if within == nil || within[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// indexMessage updates the room's search index in tx for a message replacing
+// prev, which is nil if the message is new.
+func indexMessage(tx *bolt.Tx, room string, prev, msg *proto.Message) error {
+	index, err := nestedBucket(tx, []string{searchBucket, room}, true)
+	if err != nil {
+		return err
+	}
+	id := idKey(msg.ID)
+	if prev != nil {
+		for _, term := range searchTerms(prev.Content) {
+			if err := index.Delete(append(termPrefix(term), id...)); err != nil {
+				return err
+			}
+		}
+	}
+	if isDeleted(msg) {
+		return nil
+	}
+	for _, term := range searchTerms(msg.Content) {
+		if err := index.Put(append(termPrefix(term), id...), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTerms splits text into lower case words, dropping punctuation.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func termPrefix(term string) []byte {
+	return append([]byte(term), 0)
+}
+
+// isDeleted reports whether msg has been deleted.
+func isDeleted(msg *proto.Message) bool {
+	t := time.Time(msg.Deleted)
+	return !t.IsZero() && t.Unix() > 0
+}
+
+type snowflakes []snowflake.Snowflake
+
+func (s snowflakes) Len() int           { return len(s) }
+func (s snowflakes) Less(i, j int) bool { return s[i] < s[j] }
+func (s snowflakes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
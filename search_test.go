@@ -0,0 +1,139 @@
+package gobot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/boltdb/bolt"
+	. "gopkg.in/check.v1"
+)
+
+type SearchSuite struct {
+	dir string
+	db  *bolt.DB
+}
+
+var _ = Suite(&SearchSuite{})
+
+func (s *SearchSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "gobot-search")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.db, err = bolt.Open(filepath.Join(dir, "test.db"), 0666, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *SearchSuite) TearDownTest(c *C) {
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *SearchSuite) fill(c *C) *Archive {
+	a := &Archive{db: s.db, room: "test", index: true}
+	for _, msg := range []proto.Message{
+		archived(1, 0, "alice", "Check out https://example.com/cats"),
+		archived(2, 1, "bob", "cats are great"),
+		archived(3, 0, "carol", "great, more cats"),
+		archived(60*24, 0, "bob", "Example: cats sleep a lot"),
+	} {
+		putMessage(c, a, msg)
+	}
+	return a
+}
+
+func (s *SearchSuite) TestParseSearch(c *C) {
+	q, err := ParseSearch(`cats "Are  GREAT" from:bob since:2015-06-01 until:2015-06-02 example.com`)
+	c.Assert(err, IsNil)
+	c.Check(q.Terms, DeepEquals, []string{"cats"})
+	c.Check(q.Phrases, DeepEquals, []string{"are great", "example com"})
+	c.Check(q.From, Equals, "bob")
+	c.Check(q.Since, Equals, time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC))
+	c.Check(q.Until, Equals, time.Date(2015, 6, 3, 0, 0, 0, 0, time.UTC))
+
+	q, err = ParseSearch(`"unterminated phrase`)
+	c.Check(err, IsNil)
+	c.Check(q.Phrases, DeepEquals, []string{"unterminated phrase"})
+
+	_, err = ParseSearch("since:yesterday")
+	c.Check(err, ErrorMatches, `Invalid date "yesterday", expected YYYY-MM-DD`)
+	_, err = ParseSearch(" ... ")
+	c.Check(err, ErrorMatches, "Empty search")
+}
+
+func (s *SearchSuite) TestSearch(c *C) {
+	a := s.fill(c)
+	for _, t := range []struct {
+		search string
+		limit  int
+		want   []snowflake.Snowflake
+	}{
+		{"cats", 0, []snowflake.Snowflake{60 * 24, 3, 2, 1}},
+		{"cats", 2, []snowflake.Snowflake{60 * 24, 3}},
+		{"CATS great", 0, []snowflake.Snowflake{3, 2}},
+		{`"cats are"`, 0, []snowflake.Snowflake{2}},
+		{`"are cats"`, 0, []snowflake.Snowflake{}},
+		{"example.com", 0, []snowflake.Snowflake{1}},
+		{"cats from:Bob", 0, []snowflake.Snowflake{60 * 24, 2}},
+		{"cats until:2015-06-01", 0, []snowflake.Snowflake{3, 2, 1}},
+		{"from:bob since:2015-06-02", 0, []snowflake.Snowflake{60 * 24}},
+		{"dogs", 0, []snowflake.Snowflake{}},
+	} {
+		q, err := ParseSearch(t.search)
+		c.Assert(err, IsNil)
+		q.Limit = t.limit
+		msgs, err := a.Search(q)
+		c.Check(err, IsNil)
+		c.Check(append(messageIDs(msgs), []snowflake.Snowflake{}...), DeepEquals, t.want, Commentf(t.search))
+	}
+}
+
+func (s *SearchSuite) TestIndexFollowsEdits(c *C) {
+	a := s.fill(c)
+	edited := archived(2, 1, "bob", "dogs are great")
+	putMessage(c, a, edited)
+	deleted := archived(3, 0, "carol", "great, more cats")
+	deleted.Deleted = proto.Time(archiveEpoch.Add(time.Hour))
+	putMessage(c, a, deleted)
+
+	msgs, err := a.Search(SearchQuery{Terms: []string{"great"}})
+	c.Check(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{2})
+	msgs, err = a.Search(SearchQuery{Terms: []string{"cats"}, Filter: func(msg *proto.Message) bool {
+		return msg.Sender.Name != "bob"
+	}})
+	c.Check(err, IsNil)
+	c.Check(messageIDs(msgs), DeepEquals, []snowflake.Snowflake{1})
+}
+
+func (s *SearchSuite) TestRoomIndexes(c *C) {
+	b, err := NewBot(BotConfig{Name: "test", DbPath: filepath.Join(s.dir, "bot.db")})
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	conn := &MockConn{
+		outgoing: make(chan *proto.Packet),
+		incoming: make(chan *proto.Packet),
+	}
+	b.AddRoom(RoomConfig{RoomName: "test", Conn: conn, Archive: true, Search: true})
+	room, _ := b.Room("test")
+	go room.Run()
+
+	send, _ := MakePacket(proto.SendEventType, proto.SendEvent(archived(13, 0, "alice", "cats are great")))
+	conn.incoming <- send
+	waitFor(c, func() bool {
+		msgs, _ := room.Archive().Search(SearchQuery{Terms: []string{"cats"}})
+		return len(msgs) == 1
+	})
+}
+
+func (s *SearchSuite) TestMessageURL(c *C) {
+	u, err := ServerConfig{}.messageURL("test", 1234)
+	c.Check(err, IsNil)
+	c.Check(u, Equals, "https://euphoria.io/room/test/#ya")
+	u, err = ServerConfig{URL: "ws://localhost:8080/heim"}.messageURL("test", 1234)
+	c.Check(err, IsNil)
+	c.Check(u, Equals, "http://localhost:8080/heim/room/test/#ya")
+}
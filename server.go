@@ -0,0 +1,166 @@
+package gobot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto/snowflake"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultServerURL is the heim server rooms connect to when no URL is
+// configured.
+const DefaultServerURL = "wss://euphoria.io"
+
+// ServerConfig selects the heim server a room connects to and how. It can be
+// set per bot in BotConfig and per room in RoomConfig; fields set for a room
+// override the bot's, and Headers are merged.
+type ServerConfig struct {
+	// URL is the base URL of the server, such as "wss://euphoria.io" or
+	// "ws://localhost:8080" for a local instance. Rooms are found at
+	// URL/room/<name>/ws. The http and https schemes are accepted as
+	// synonyms for ws and wss.
+	URL string `yaml:"URL,omitempty"`
+
+	// RootCAs is the path to a PEM file of certificate authorities to trust
+	// instead of the system's, for servers with private certificates.
+	RootCAs string `yaml:"RootCAs,omitempty"`
+
+	// Proxy is the URL of an HTTP proxy to connect through. No proxy is used
+	// if it is empty.
+	Proxy string `yaml:"Proxy,omitempty"`
+
+	// Headers are added to the websocket handshake request.
+	Headers map[string]string `yaml:"Headers,omitempty"`
+}
+
+// merge returns sc with its unset fields taken from defaults.
+func (sc ServerConfig) merge(defaults ServerConfig) ServerConfig {
+	if sc.URL == "" {
+		sc.URL = defaults.URL
+	}
+	if sc.RootCAs == "" {
+		sc.RootCAs = defaults.RootCAs
+	}
+	if sc.Proxy == "" {
+		sc.Proxy = defaults.Proxy
+	}
+	if len(defaults.Headers) > 0 {
+		headers := make(map[string]string, len(defaults.Headers)+len(sc.Headers))
+		for k, v := range defaults.Headers {
+			headers[k] = v
+		}
+		for k, v := range sc.Headers {
+			headers[k] = v
+		}
+		sc.Headers = headers
+	}
+	return sc
+}
+
+// roomURL returns the websocket URL of the named room.
+func (sc ServerConfig) roomURL(roomName string) (string, error) {
+	base := sc.URL
+	if base == "" {
+		base = DefaultServerURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server URL %q: %s", base, err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("Invalid server URL %q: scheme must be ws or wss", base)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid server URL %q: no host", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/room/" + url.PathEscape(roomName) + "/ws"
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// messageURL returns the web URL of a message in the named room.
+func (sc ServerConfig) messageURL(roomName string, id snowflake.Snowflake) (string, error) {
+	wsURL, err := sc.roomURL(roomName)
+	if err != nil {
+		return "", err
+	}
+	u, _ := url.Parse(wsURL)
+	if u.Scheme == "ws" {
+		u.Scheme = "http"
+	} else {
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "ws")
+	u.Fragment = id.String()
+	return u.String(), nil
+}
+
+// MessageURL returns the link to a message in the room, as shown by the web
+// client, or the empty string if the room's server URL is invalid.
+func (r *Room) MessageURL(id snowflake.Snowflake) string {
+	u, err := r.server.messageURL(r.RoomName, id)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+// dialer returns a websocket dialer using the configured root CAs and proxy.
+func (sc ServerConfig) dialer() (*websocket.Dialer, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 5 * time.Second,
+	}
+	if sc.RootCAs != "" {
+		pem, err := ioutil.ReadFile(sc.RootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read root CAs: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", sc.RootCAs)
+		}
+		dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if sc.Proxy != "" {
+		proxy, err := url.Parse(sc.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL %q: %s", sc.Proxy, err)
+		}
+		dialer.Proxy = http.ProxyURL(proxy)
+	}
+	return dialer, nil
+}
+
+// header returns the configured handshake headers.
+func (sc ServerConfig) header() http.Header {
+	if len(sc.Headers) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(sc.Headers))
+	for k, v := range sc.Headers {
+		header.Set(k, v)
+	}
+	return header
+}
+
+// Validate checks that the server URL, root CAs and proxy are usable.
+func (sc ServerConfig) Validate() error {
+	if _, err := sc.roomURL("test"); err != nil {
+		return err
+	}
+	_, err := sc.dialer()
+	return err
+}
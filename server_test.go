@@ -0,0 +1,175 @@
+package gobot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "gopkg.in/check.v1"
+)
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestRoomURL(c *C) {
+	for base, want := range map[string]string{
+		"":                         "wss://euphoria.io/room/test/ws",
+		"ws://localhost:8080":      "ws://localhost:8080/room/test/ws",
+		"https://chat.example/":    "wss://chat.example/room/test/ws",
+		"http://example/heim/base": "ws://example/heim/base/room/test/ws",
+	} {
+		url, err := ServerConfig{URL: base}.roomURL("test")
+		c.Check(err, IsNil)
+		c.Check(url, Equals, want)
+	}
+	_, err := ServerConfig{URL: "ftp://example"}.roomURL("test")
+	c.Check(err, NotNil)
+}
+
+func (s *ServerSuite) TestMerge(c *C) {
+	bot := ServerConfig{
+		URL:     "wss://bot.example",
+		Proxy:   "http://proxy:3128",
+		Headers: map[string]string{"X-A": "bot", "X-B": "bot"},
+	}
+	room := ServerConfig{URL: "ws://room.example", Headers: map[string]string{"X-B": "room"}}
+	merged := room.merge(bot)
+	c.Check(merged.URL, Equals, "ws://room.example")
+	c.Check(merged.Proxy, Equals, "http://proxy:3128")
+	c.Check(merged.Headers, DeepEquals, map[string]string{"X-A": "bot", "X-B": "room"})
+}
+
+func (s *ServerSuite) TestValidate(c *C) {
+	c.Check(ServerConfig{RootCAs: "/nonexistent/ca.pem"}.Validate(), NotNil)
+	c.Check(ServerConfig{Proxy: "://bad"}.Validate(), NotNil)
+	c.Check(ServerConfig{URL: "ws://localhost", Proxy: "http://proxy:3128"}.Validate(), IsNil)
+}
+
+func (s *ServerSuite) TestConnectLocal(c *C) {
+	headers := make(chan http.Header, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/room/test/ws" {
+			http.NotFound(w, req)
+			return
+		}
+		headers <- req.Header
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	bcfg := BotConfig{
+		Name:   "test",
+		DbPath: "test.db",
+		Server: ServerConfig{Headers: map[string]string{"X-Bot": "gobot"}},
+	}
+	b, err := NewBot(bcfg)
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	conn := &WSConnection{}
+	b.AddRoom(RoomConfig{
+		RoomName: "test",
+		Server:   ServerConfig{URL: strings.Replace(srv.URL, "http://", "ws://", 1)},
+		Conn:     conn,
+	})
+	room, _ := b.Room("test")
+	c.Assert(conn.connectOnce(room, 0), IsNil)
+	c.Check((<-headers).Get("X-Bot"), Equals, "gobot")
+}
+
+// wsServer serves websockets for the test room, passing the number of each
+// dial and its connection to serve. Dials after the first accept are refused.
+func wsServer(accept int32, serve func(n int32, conn *websocket.Conn)) (*httptest.Server, *int32) {
+	var dials int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&dials, 1)
+		if n > accept {
+			http.Error(w, "refused", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		serve(n, conn)
+	}))
+	return srv, &dials
+}
+
+func (s *ServerSuite) wsRoom(c *C, srv *httptest.Server, conn *WSConnection) (*Bot, *Room) {
+	b, err := NewBot(BotConfig{Name: "test", DbPath: "test.db"})
+	c.Assert(err, IsNil)
+	b.AddRoom(RoomConfig{
+		RoomName:        "test",
+		Server:          ServerConfig{URL: strings.Replace(srv.URL, "http://", "ws://", 1)},
+		Conn:            conn,
+		ReconnectPolicy: &ExponentialBackoff{Initial: time.Millisecond, MaxRetries: 2},
+	})
+	room, _ := b.Room("test")
+	return b, room
+}
+
+func (s *ServerSuite) TestReconnectGivesUp(c *C) {
+	srv, _ := wsServer(1, func(n int32, conn *websocket.Conn) {
+		conn.Close()
+	})
+	defer srv.Close()
+	b, room := s.wsRoom(c, srv, &WSConnection{})
+	defer b.Stop()
+	result := make(chan error, 1)
+	go func() {
+		result <- room.Run()
+	}()
+	select {
+	case err := <-result:
+		c.Check(err, NotNil)
+	case <-time.After(2 * time.Second):
+		c.Fatal("room kept reconnecting after its ReconnectPolicy gave up")
+	}
+}
+
+func (s *ServerSuite) TestReconnectClosesPrevious(c *C) {
+	closed := make(chan int32, 2)
+	srv, dials := wsServer(10, func(n int32, conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- n
+				return
+			}
+		}
+	})
+	defer srv.Close()
+	conn := &WSConnection{}
+	b, room := s.wsRoom(c, srv, conn)
+	defer b.Stop()
+	c.Assert(conn.Connect(room), IsNil)
+	first := conn.current()
+
+	// Both loops see the first connection fail, but only one of them dials.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(conn.reconnect(room, first), IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Check(atomic.LoadInt32(dials), Equals, int32(2))
+	select {
+	case n := <-closed:
+		c.Check(n, Equals, int32(1))
+	case <-time.After(time.Second):
+		c.Fatal("the replaced connection was not closed")
+	}
+}
@@ -0,0 +1,331 @@
+package gobot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// storeBucket is the top-level bolt bucket holding the namespaces of all
+// Stores. Bucket names starting with "_gobot" are reserved for the framework.
+const storeBucket = "_gobot_store"
+
+// Value is a JSON-encoded value passed to the function given to ForEach. It is
+// only valid until the function returns.
+type Value []byte
+
+// Decode unmarshals the value into v.
+func (v Value) Decode(dst interface{}) error {
+	return json.Unmarshal(v, dst)
+}
+
+// Bucket holds JSON-encoded values under string keys.
+type Bucket interface {
+	// Get decodes the value stored under key into v and reports whether
+	// there was one.
+	Get(key string, v interface{}) (bool, error)
+
+	// Put stores v under key.
+	Put(key string, v interface{}) error
+
+	// Delete removes the value stored under key, if any.
+	Delete(key string) error
+
+	// ForEach calls fn for each key starting with prefix, in key order,
+	// stopping at the first error.
+	ForEach(prefix string, fn func(key string, value Value) error) error
+}
+
+// Store is a namespaced Bucket. Each of its methods runs in a transaction of
+// its own; use View or Update to run several in one transaction. The Bucket
+// passed to fn must be used instead of the Store itself inside fn, and is
+// read-only in View.
+type Store interface {
+	Bucket
+	View(fn func(b Bucket) error) error
+	Update(fn func(b Bucket) error) error
+}
+
+// Storage provides the Stores of a bot. NewBot uses a bolt Storage in the
+// bot's DB; use NewMemoryStorage in tests to keep handlers off the disk.
+type Storage interface {
+	// Store returns the Store for a namespace. Stores for different
+	// namespaces never share keys.
+	Store(namespace ...string) Store
+}
+
+// Store returns the named store shared by all of the bot's rooms. Handlers
+// should pass a name of their own, such as "karma".
+func (b *Bot) Store(name string) Store {
+	return b.Storage.Store(name, "bot")
+}
+
+// Store returns the named store for this room. Handlers should pass a name of
+// their own, such as "karma"; other rooms using the same name get separate
+// stores.
+func (r *Room) Store(name string) Store {
+	return r.Storage.Store(name, "room", r.RoomName)
+}
+
+// errReadOnly is returned by writes to a Bucket in a View.
+var errReadOnly = fmt.Errorf("Cannot write to store in a read-only transaction")
+
+// NewBoltStorage returns a Storage keeping its stores in nested buckets of db.
+func NewBoltStorage(db *bolt.DB) Storage {
+	return &boltStorage{db: db}
+}
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func (s *boltStorage) Store(namespace ...string) Store {
+	path := append([]string{storeBucket}, namespace...)
+	return &boltStore{db: s.db, path: path}
+}
+
+type boltStore struct {
+	db   *bolt.DB
+	path []string
+}
+
+// bucket returns the store's bucket in tx, creating it if create is set. It
+// returns nil if the bucket does not exist and create is not set.
+func (s *boltStore) bucket(tx *bolt.Tx, create bool) (*bolt.Bucket, error) {
+	return nestedBucket(tx, s.path, create)
+}
+
+// nestedBucket returns the bucket at path in tx, creating it if create is set.
+// It returns nil if the bucket does not exist and create is not set.
+func nestedBucket(tx *bolt.Tx, path []string, create bool) (*bolt.Bucket, error) {
+	var b *bolt.Bucket
+	for i, name := range path {
+		var err error
+		switch {
+		case create && i == 0:
+			b, err = tx.CreateBucketIfNotExists([]byte(name))
+		case create:
+			b, err = b.CreateBucketIfNotExists([]byte(name))
+		case i == 0:
+			b = tx.Bucket([]byte(name))
+		default:
+			b = b.Bucket([]byte(name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return nil, nil
+		}
+	}
+	return b, nil
+}
+
+func (s *boltStore) View(fn func(b Bucket) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, false)
+		if err != nil {
+			return err
+		}
+		return fn(&boltBucket{b: b})
+	})
+}
+
+func (s *boltStore) Update(fn func(b Bucket) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, true)
+		if err != nil {
+			return err
+		}
+		return fn(&boltBucket{b: b, writable: true})
+	})
+}
+
+func (s *boltStore) Get(key string, v interface{}) (found bool, err error) {
+	err = s.View(func(b Bucket) error {
+		found, err = b.Get(key, v)
+		return err
+	})
+	return found, err
+}
+
+func (s *boltStore) Put(key string, v interface{}) error {
+	return s.Update(func(b Bucket) error { return b.Put(key, v) })
+}
+
+func (s *boltStore) Delete(key string) error {
+	return s.Update(func(b Bucket) error { return b.Delete(key) })
+}
+
+func (s *boltStore) ForEach(prefix string, fn func(key string, value Value) error) error {
+	return s.View(func(b Bucket) error { return b.ForEach(prefix, fn) })
+}
+
+// boltBucket is a store's bucket in a transaction. b is nil in a View if the
+// bucket has not been created yet.
+type boltBucket struct {
+	b        *bolt.Bucket
+	writable bool
+}
+
+func (b *boltBucket) Get(key string, v interface{}) (bool, error) {
+	if b.b == nil {
+		return false, nil
+	}
+	data := b.b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (b *boltBucket) Put(key string, v interface{}) error {
+	if !b.writable {
+		return errReadOnly
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.b.Put([]byte(key), data)
+}
+
+func (b *boltBucket) Delete(key string) error {
+	if !b.writable {
+		return errReadOnly
+	}
+	return b.b.Delete([]byte(key))
+}
+
+func (b *boltBucket) ForEach(prefix string, fn func(key string, value Value) error) error {
+	if b.b == nil {
+		return nil
+	}
+	c := b.b.Cursor()
+	p := []byte(prefix)
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if v == nil {
+			continue
+		}
+		if err := fn(string(k), Value(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMemoryStorage returns a Storage that keeps its stores in memory. Updates
+// are applied atomically when their function returns nil, like bolt's.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{buckets: make(map[string]map[string][]byte)}
+}
+
+type memoryStorage struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func (s *memoryStorage) Store(namespace ...string) Store {
+	return &memoryStore{s: s, name: strings.Join(namespace, "\x00")}
+}
+
+type memoryStore struct {
+	s    *memoryStorage
+	name string
+}
+
+func (s *memoryStore) View(fn func(b Bucket) error) error {
+	s.s.mu.RLock()
+	defer s.s.mu.RUnlock()
+	return fn(&memoryBucket{data: s.s.buckets[s.name]})
+}
+
+func (s *memoryStore) Update(fn func(b Bucket) error) error {
+	s.s.mu.Lock()
+	defer s.s.mu.Unlock()
+	data := make(map[string][]byte, len(s.s.buckets[s.name]))
+	for k, v := range s.s.buckets[s.name] {
+		data[k] = v
+	}
+	if err := fn(&memoryBucket{data: data, writable: true}); err != nil {
+		return err
+	}
+	s.s.buckets[s.name] = data
+	return nil
+}
+
+func (s *memoryStore) Get(key string, v interface{}) (found bool, err error) {
+	err = s.View(func(b Bucket) error {
+		found, err = b.Get(key, v)
+		return err
+	})
+	return found, err
+}
+
+func (s *memoryStore) Put(key string, v interface{}) error {
+	return s.Update(func(b Bucket) error { return b.Put(key, v) })
+}
+
+func (s *memoryStore) Delete(key string) error {
+	return s.Update(func(b Bucket) error { return b.Delete(key) })
+}
+
+func (s *memoryStore) ForEach(prefix string, fn func(key string, value Value) error) error {
+	return s.View(func(b Bucket) error { return b.ForEach(prefix, fn) })
+}
+
+// memoryBucket is a store's data in a transaction. In an Update, data is a
+// copy that replaces the store's data if the update succeeds.
+type memoryBucket struct {
+	data     map[string][]byte
+	writable bool
+}
+
+func (b *memoryBucket) Get(key string, v interface{}) (bool, error) {
+	data, ok := b.data[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (b *memoryBucket) Put(key string, v interface{}) error {
+	if !b.writable {
+		return errReadOnly
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.data[key] = data
+	return nil
+}
+
+func (b *memoryBucket) Delete(key string) error {
+	if !b.writable {
+		return errReadOnly
+	}
+	delete(b.data, key)
+	return nil
+}
+
+func (b *memoryBucket) ForEach(prefix string, fn func(key string, value Value) error) error {
+	keys := make([]string, 0, len(b.data))
+	for k := range b.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, Value(b.data[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
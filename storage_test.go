@@ -0,0 +1,149 @@
+package gobot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	. "gopkg.in/check.v1"
+)
+
+type StorageSuite struct {
+	dir string
+	db  *bolt.DB
+}
+
+var _ = Suite(&StorageSuite{})
+
+func (s *StorageSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "gobot-storage")
+	c.Assert(err, IsNil)
+	s.dir = dir
+	s.db, err = bolt.Open(filepath.Join(dir, "test.db"), 0666, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *StorageSuite) TearDownTest(c *C) {
+	s.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *StorageSuite) storages() map[string]Storage {
+	return map[string]Storage{
+		"bolt":   NewBoltStorage(s.db),
+		"memory": NewMemoryStorage(),
+	}
+}
+
+type karma struct {
+	Nick  string
+	Score int
+}
+
+func (s *StorageSuite) TestGetPutDelete(c *C) {
+	for name, storage := range s.storages() {
+		c.Logf("storage %s", name)
+		store := storage.Store("karma", "room", "test")
+		var k karma
+		found, err := store.Get("alice", &k)
+		c.Check(err, IsNil)
+		c.Check(found, Equals, false)
+
+		c.Assert(store.Put("alice", karma{"alice", 3}), IsNil)
+		found, err = store.Get("alice", &k)
+		c.Check(err, IsNil)
+		c.Check(found, Equals, true)
+		c.Check(k, Equals, karma{"alice", 3})
+
+		c.Assert(store.Delete("alice"), IsNil)
+		found, _ = store.Get("alice", &k)
+		c.Check(found, Equals, false)
+	}
+}
+
+func (s *StorageSuite) TestNamespaces(c *C) {
+	for name, storage := range s.storages() {
+		c.Logf("storage %s", name)
+		c.Assert(storage.Store("karma", "room", "a").Put("alice", 1), IsNil)
+		c.Assert(storage.Store("karma", "room", "b").Put("alice", 2), IsNil)
+		c.Assert(storage.Store("quotes", "room", "a").Put("alice", 3), IsNil)
+		for i, ns := range [][]string{{"karma", "room", "a"}, {"karma", "room", "b"}, {"quotes", "room", "a"}} {
+			var v int
+			_, err := storage.Store(ns...).Get("alice", &v)
+			c.Check(err, IsNil)
+			c.Check(v, Equals, i+1)
+		}
+	}
+}
+
+func (s *StorageSuite) TestForEachPrefix(c *C) {
+	for name, storage := range s.storages() {
+		c.Logf("storage %s", name)
+		store := storage.Store("karma", "bot")
+		for _, key := range []string{"user:bob", "other", "user:alice", "user:carol"} {
+			c.Assert(store.Put(key, karma{Nick: key}), IsNil)
+		}
+		var keys []string
+		err := store.ForEach("user:", func(key string, value Value) error {
+			var k karma
+			if err := value.Decode(&k); err != nil {
+				return err
+			}
+			c.Check(k.Nick, Equals, key)
+			keys = append(keys, key)
+			return nil
+		})
+		c.Check(err, IsNil)
+		c.Check(keys, DeepEquals, []string{"user:alice", "user:bob", "user:carol"})
+	}
+}
+
+func (s *StorageSuite) TestTransactions(c *C) {
+	for name, storage := range s.storages() {
+		c.Logf("storage %s", name)
+		store := storage.Store("karma", "bot")
+		c.Assert(store.Put("alice", 1), IsNil)
+		err := store.Update(func(b Bucket) error {
+			if err := b.Put("alice", 2); err != nil {
+				return err
+			}
+			if err := b.Put("bob", 1); err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback")
+		})
+		c.Check(err, ErrorMatches, "rollback")
+		var v int
+		store.Get("alice", &v)
+		c.Check(v, Equals, 1)
+		found, _ := store.Get("bob", &v)
+		c.Check(found, Equals, false)
+
+		err = store.View(func(b Bucket) error { return b.Put("alice", 3) })
+		c.Check(err, Equals, errReadOnly)
+
+		c.Check(storage.Store("empty").View(func(b Bucket) error {
+			found, err := b.Get("x", &v)
+			c.Check(found, Equals, false)
+			return err
+		}), IsNil)
+	}
+}
+
+func (s *StorageSuite) TestRoomStore(c *C) {
+	b, _, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ := b.Room("test")
+	c.Assert(room.Store("karma").Put("alice", 1), IsNil)
+	var v int
+	found, _ := b.Store("karma").Get("alice", &v)
+	c.Check(found, Equals, false)
+	found, _ = NewBoltStorage(b.DB).Store("karma", "room", "test").Get("alice", &v)
+	c.Check(found, Equals, true)
+
+	memory := &Room{RoomName: "test", Storage: NewMemoryStorage()}
+	c.Check(memory.Store("karma").Put("alice", 1), IsNil)
+}
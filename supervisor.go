@@ -0,0 +1,272 @@
+package gobot
+
+import (
+	"sync"
+	"time"
+
+	"euphoria.io/scope"
+)
+
+// RestartPolicy controls whether a room is started again after its Run method
+// returns without the room having been stopped deliberately.
+type RestartPolicy string
+
+const (
+	// RestartNever leaves the room stopped once Run returns. This is the
+	// default.
+	RestartNever RestartPolicy = "never"
+
+	// RestartOnFailure restarts the room only if its context was terminated
+	// with an error, e.g. after a disconnect-event or a failed send.
+	RestartOnFailure RestartPolicy = "on-failure"
+
+	// RestartAlways restarts the room whenever Run returns, unless the room
+	// was stopped through Room.Stop, Bot.LeaveRoom or Bot.Stop.
+	RestartAlways RestartPolicy = "always"
+)
+
+const (
+	// DefaultRestartBackoff is the delay before the first restart of a room
+	// when RoomConfig.RestartBackoff is not set.
+	DefaultRestartBackoff = time.Second
+
+	// DefaultMaxRestartBackoff caps the delay between restarts when
+	// RoomConfig.MaxRestartBackoff is not set.
+	DefaultMaxRestartBackoff = 2 * time.Minute
+
+	// restartResetAfter is how long a room must stay up for its backoff to
+	// start over from RestartBackoff.
+	restartResetAfter = 5 * time.Minute
+)
+
+// supervisor runs a single room and restarts it according to the room's
+// RestartPolicy. Each restart builds a new Room with a fresh context and
+// channels from the original RoomConfig, keeping the previous room's handlers.
+// Once the supervisor has exited, finished is set and err holds the error that
+// ended its room, or nil if the room was stopped deliberately; both are guarded
+// by the bot's roomsMu.
+type supervisor struct {
+	bot       *Bot
+	room      *Room
+	restarts  int
+	backoff   time.Duration
+	stop      chan struct{}
+	stopOnce  sync.Once
+	exited    chan struct{}
+	restartCh chan chan struct{}
+	finished  bool
+	err       error
+}
+
+func newSupervisor(b *Bot, room *Room) *supervisor {
+	return &supervisor{
+		bot:       b,
+		room:      room,
+		stop:      make(chan struct{}),
+		exited:    make(chan struct{}),
+		restartCh: make(chan chan struct{}, 1),
+	}
+}
+
+// run is the supervisor's main loop. It returns when the room is stopped
+// deliberately, the supervisor is stopped, the bot is stopped, or the restart
+// policy says the room should stay down.
+func (s *supervisor) run() {
+	defer s.bot.ctx.WaitGroup().Done()
+	defer close(s.exited)
+	defer s.bot.supervisorExited(s)
+	room := s.room
+	for {
+		started := time.Now()
+		done, err := s.runRoom(room)
+		deliberate := room.stopRequested()
+		if !deliberate {
+			room.Logger.Errorf("Error in room %s: %s", room.RoomName, err)
+		}
+		if err := room.shutdown(); err != nil {
+			room.Logger.Errorf("Error stopping room %s: %s", room.RoomName, err)
+		}
+
+		if done == nil {
+			select {
+			case done = <-s.restartCh:
+			default:
+			}
+		}
+		if done != nil {
+			room = s.rebuild(room)
+			close(done)
+			continue
+		}
+		if deliberate || s.stopped() {
+			return
+		}
+		if !s.shouldRestart(room) {
+			room.Logger.Warnf("Room %s will not be restarted.", room.RoomName)
+			s.bot.roomsMu.Lock()
+			s.err = err
+			s.bot.roomsMu.Unlock()
+			return
+		}
+
+		if time.Since(started) > restartResetAfter {
+			s.backoff = 0
+		}
+		delay := s.nextBackoff(room.cfg)
+		s.restarts++
+		s.bot.metrics.restarted(room.RoomName)
+		room.Logger.Warnf("Restarting room %s in %s (restart #%d)", room.RoomName, delay, s.restarts)
+		room.storeState(RoomRestarting)
+		select {
+		case <-time.After(delay):
+			room = s.rebuild(room)
+		case done := <-s.restartCh:
+			room = s.rebuild(room)
+			close(done)
+		case <-s.stop:
+			room.storeState(RoomStopped)
+			return
+		case <-s.bot.ctx.Done():
+			return
+		}
+	}
+}
+
+// runRoom runs room until its Run method returns. If a restart is requested,
+// or the supervisor or the bot is stopped meanwhile, the supervisor stops the
+// room itself, so that only the room it owns is stopped. It returns the
+// restart request, if any, to be completed once the room has been replaced.
+func (s *supervisor) runRoom(room *Room) (chan struct{}, error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- room.Run()
+	}()
+	select {
+	case err := <-result:
+		return nil, err
+	case <-s.stop:
+		if err := room.Stop(); err != nil {
+			room.Logger.Warningf("Error stopping room %s: %s", room.RoomName, err)
+		}
+		return nil, <-result
+	case <-s.bot.ctx.Done():
+		if err := room.Stop(); err != nil {
+			room.Logger.Warningf("Error stopping room %s: %s", room.RoomName, err)
+		}
+		return nil, <-result
+	case done := <-s.restartCh:
+		if err := room.Stop(); err != nil {
+			room.Logger.Warningf("Error stopping room %s for restart: %s", room.RoomName, err)
+		}
+		return done, <-result
+	}
+}
+
+// shouldRestart applies the room's restart policy and restart limit to a room
+// whose Run method has returned without a deliberate stop.
+func (s *supervisor) shouldRestart(room *Room) bool {
+	cfg := room.cfg
+	if cfg.MaxRestarts > 0 && s.restarts >= cfg.MaxRestarts {
+		room.Logger.Errorf("Room %s reached its limit of %d restarts", room.RoomName, cfg.MaxRestarts)
+		return false
+	}
+	switch cfg.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return room.Ctx.Err() != scope.Cancelled
+	default:
+		return false
+	}
+}
+
+// nextBackoff doubles the delay between restarts, starting at RestartBackoff
+// and capped at MaxRestartBackoff.
+func (s *supervisor) nextBackoff(cfg RoomConfig) time.Duration {
+	initial := cfg.RestartBackoff
+	if initial <= 0 {
+		initial = DefaultRestartBackoff
+	}
+	max := cfg.MaxRestartBackoff
+	if max <= 0 {
+		max = DefaultMaxRestartBackoff
+	}
+	if s.backoff == 0 {
+		s.backoff = initial
+	} else {
+		s.backoff *= 2
+	}
+	if s.backoff > max {
+		s.backoff = max
+	}
+	return s.backoff
+}
+
+// rebuild creates a new Room from the old room's configuration and handlers
+// and registers it with the bot in place of the old one.
+func (s *supervisor) rebuild(old *Room) *Room {
+	room := s.bot.newRoom(old.cfg)
+	room.Handlers = old.Handlers
+	room.carryPause(old)
+	s.bot.roomsMu.Lock()
+	if s.bot.Rooms[old.RoomName] == old {
+		s.bot.Rooms[old.RoomName] = room
+	}
+	s.room = room
+	s.bot.roomsMu.Unlock()
+	return room
+}
+
+// current returns the room the supervisor is running.
+func (s *supervisor) current() *Room {
+	s.bot.roomsMu.RLock()
+	defer s.bot.roomsMu.RUnlock()
+	return s.room
+}
+
+// halt stops the supervisor and the room it is running or waiting to restart,
+// and waits for the supervisor to exit. It returns false if the supervisor had
+// already exited.
+func (s *supervisor) halt() bool {
+	select {
+	case <-s.exited:
+		return false
+	default:
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	select {
+	case <-s.exited:
+	case <-s.bot.ctx.Done():
+	}
+	return true
+}
+
+func (s *supervisor) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// restart asks the supervisor to stop its room, whether it is running or
+// waiting to be restarted, and waits until the supervisor has started its
+// replacement. The restart does not count against MaxRestarts. It returns
+// false if the supervisor had already exited and so will not restart the room.
+func (s *supervisor) restart() bool {
+	done := make(chan struct{})
+	select {
+	case s.restartCh <- done:
+	case <-s.exited:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-s.exited:
+		return false
+	case <-s.bot.ctx.Done():
+		return true
+	}
+}
@@ -0,0 +1,122 @@
+package gobot
+
+import (
+	"sort"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+)
+
+// link records msg as a reply to its parent. The caller must hold mc.mu.
+func (mc *messageCache) link(msg proto.Message) {
+	if msg.Parent == 0 {
+		return
+	}
+	if mc.replies == nil {
+		mc.replies = make(map[snowflake.Snowflake][]snowflake.Snowflake)
+	}
+	ids := mc.replies[msg.Parent]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= msg.ID })
+	if i < len(ids) && ids[i] == msg.ID {
+		return
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = msg.ID
+	mc.replies[msg.Parent] = ids
+}
+
+// unlink removes an evicted message from its parent's replies. Its own
+// replies are newer, so they are still cached and stay indexed until they are
+// evicted in turn. The caller must hold mc.mu.
+func (mc *messageCache) unlink(msg proto.Message) {
+	ids := mc.replies[msg.Parent]
+	for i, id := range ids {
+		if id == msg.ID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(mc.replies, msg.Parent)
+	} else {
+		mc.replies[msg.Parent] = ids
+	}
+}
+
+// get returns the cached message with the given ID. The caller must hold
+// mc.mu.
+func (mc *messageCache) get(id snowflake.Snowflake) (proto.Message, bool) {
+	if i := mc.find(id); i < len(mc.msgs) && mc.msgs[i].ID == id {
+		return mc.msgs[i], true
+	}
+	return proto.Message{}, false
+}
+
+// ancestors returns a cached message and its cached ancestors, starting with
+// its parent. It returns false if the message is not cached.
+func (mc *messageCache) ancestors(id snowflake.Snowflake) (proto.Message, []proto.Message, bool) {
+	if mc == nil {
+		return proto.Message{}, nil, false
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	msg, ok := mc.get(id)
+	if !ok {
+		return proto.Message{}, nil, false
+	}
+	var ancestors []proto.Message
+	for parent := msg.Parent; parent != 0; {
+		ancestor, ok := mc.get(parent)
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, ancestor)
+		parent = ancestor.Parent
+	}
+	return msg, ancestors, true
+}
+
+// repliesTo returns the cached replies to a message, oldest first.
+func (mc *messageCache) repliesTo(id snowflake.Snowflake) []proto.Message {
+	if mc == nil {
+		return nil
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	ids := mc.replies[id]
+	replies := make([]proto.Message, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := mc.get(id); ok {
+			replies = append(replies, msg)
+		}
+	}
+	return replies
+}
+
+// Ancestors returns the messages that the given message replies to, directly
+// or indirectly, starting with its parent. Only messages in the room's cache
+// are considered, so the list ends early if an ancestor is older than the
+// cache; the last message's Parent is then non-zero.
+func (r *Room) Ancestors(id snowflake.Snowflake) []proto.Message {
+	_, ancestors, _ := r.history.ancestors(id)
+	return ancestors
+}
+
+// ThreadRoot returns the root of the thread containing the given message,
+// which is the message itself if it is not a reply. It returns false if the
+// message is not in the room's cache. If part of the thread is older than the
+// cache, the oldest cached ancestor is returned and its Parent is non-zero.
+func (r *Room) ThreadRoot(id snowflake.Snowflake) (proto.Message, bool) {
+	msg, ancestors, ok := r.history.ancestors(id)
+	if len(ancestors) > 0 {
+		return ancestors[len(ancestors)-1], true
+	}
+	return msg, ok
+}
+
+// Replies returns the cached direct replies to the given message, oldest
+// first.
+func (r *Room) Replies(id snowflake.Snowflake) []proto.Message {
+	return r.history.repliesTo(id)
+}
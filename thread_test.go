@@ -0,0 +1,41 @@
+package gobot
+
+import (
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	. "gopkg.in/check.v1"
+)
+
+func reply(id, parent snowflake.Snowflake) proto.Message {
+	return proto.Message{ID: id, Parent: parent}
+}
+
+type ThreadSuite struct{}
+
+var _ = Suite(&ThreadSuite{})
+
+func (s *ThreadSuite) TestThreads(c *C) {
+	room := &Room{history: newMessageCache(5)}
+	room.history.reset([]proto.Message{reply(1, 0), reply(2, 1), reply(3, 0)})
+	room.history.add(reply(4, 2))
+	room.history.add(reply(5, 1))
+
+	c.Check(messageIDs(room.Ancestors(4)), DeepEquals, []snowflake.Snowflake{2, 1})
+	root, ok := room.ThreadRoot(4)
+	c.Check(ok, Equals, true)
+	c.Check(root.ID, Equals, snowflake.Snowflake(1))
+	root, ok = room.ThreadRoot(3)
+	c.Check(ok, Equals, true)
+	c.Check(root.ID, Equals, snowflake.Snowflake(3))
+	_, ok = room.ThreadRoot(42)
+	c.Check(ok, Equals, false)
+	c.Check(messageIDs(room.Replies(1)), DeepEquals, []snowflake.Snowflake{2, 5})
+
+	// Evicting the root leaves the thread rooted at its oldest cached message.
+	room.history.add(reply(6, 5))
+	c.Check(messageIDs(room.Replies(1)), DeepEquals, []snowflake.Snowflake{2, 5})
+	root, _ = room.ThreadRoot(6)
+	c.Check(root.ID, Equals, snowflake.Snowflake(5))
+	c.Check(root.Parent, Equals, snowflake.Snowflake(1))
+	c.Check(messageIDs(room.Replies(5)), DeepEquals, []snowflake.Snowflake{6})
+}
@@ -0,0 +1,263 @@
+package gobot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+)
+
+// Directions of packets in a transcript.
+const (
+	TranscriptSent     = "sent"
+	TranscriptReceived = "received"
+)
+
+// TranscriptEntry is a line of a transcript written by a RecordingConnection.
+type TranscriptEntry struct {
+	Time      time.Time     `json:"time"`
+	Direction string        `json:"direction"`
+	Packet    *proto.Packet `json:"packet"`
+}
+
+// RecordingConnection wraps a Connection and writes every packet sent and
+// received through it to a transcript, one JSON-encoded TranscriptEntry per
+// line. The transcript can be played back with a ReplayConnection.
+type RecordingConnection struct {
+	Conn Connection
+
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewRecordingConnection returns a Connection that records the traffic of conn
+// to w.
+func NewRecordingConnection(conn Connection, w io.Writer) *RecordingConnection {
+	return &RecordingConnection{Conn: conn, enc: json.NewEncoder(w)}
+}
+
+// RecordToFile returns a Connection that records the traffic of conn to the
+// file at path, appending to it if it exists. The file is closed along with
+// the connection.
+func RecordToFile(conn Connection, path string) (*RecordingConnection, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	rc := NewRecordingConnection(conn, f)
+	rc.closer = f
+	return rc, nil
+}
+
+func (rc *RecordingConnection) record(r *Room, direction string, p *proto.Packet) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry := TranscriptEntry{Time: time.Now(), Direction: direction, Packet: p}
+	if err := rc.enc.Encode(&entry); err != nil {
+		r.Logger.Errorf("Error writing transcript: %s", err)
+	}
+}
+
+// Connect connects the wrapped connection.
+func (rc *RecordingConnection) Connect(r *Room) error {
+	return rc.Conn.Connect(r)
+}
+
+// SendJSON sends msg through the wrapped connection and records it if it was
+// sent.
+func (rc *RecordingConnection) SendJSON(r *Room, msg interface{}) (string, error) {
+	id, err := rc.Conn.SendJSON(r, msg)
+	if err != nil {
+		return id, err
+	}
+	p, ok := msg.(*proto.Packet)
+	if !ok {
+		p = &proto.Packet{}
+		data, err := json.Marshal(msg)
+		if err == nil {
+			err = json.Unmarshal(data, p)
+		}
+		if err != nil {
+			r.Logger.Errorf("Error recording sent message: %s", err)
+			return id, nil
+		}
+	}
+	rc.record(r, TranscriptSent, p)
+	return id, nil
+}
+
+// ReceiveJSON receives a packet through the wrapped connection and records it.
+func (rc *RecordingConnection) ReceiveJSON(r *Room, p chan *proto.Packet) {
+	inner := make(chan *proto.Packet, 1)
+	rc.Conn.ReceiveJSON(r, inner)
+	var msg *proto.Packet
+	select {
+	case msg = <-inner:
+	default:
+		return
+	}
+	if msg != nil {
+		rc.record(r, TranscriptReceived, msg)
+	}
+	if r.Ctx.Alive() {
+		p <- msg
+	}
+}
+
+// Close closes the wrapped connection and the transcript file, if the
+// connection was created by RecordToFile.
+func (rc *RecordingConnection) Close() error {
+	err := rc.Conn.Close()
+	if rc.closer != nil {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if cerr := rc.closer.Close(); err == nil {
+			err = cerr
+		}
+		rc.closer = nil
+	}
+	return err
+}
+
+// ReplayConnection is a Connection that plays the received packets of a
+// transcript back into a Room, either as fast as possible or, if RealTime is
+// set, with the delays between them that were recorded. Packets the room sends
+// are not transmitted anywhere but are kept for inspection with Sent.
+//
+// Replies are matched to commands by packet ID, so a room replaying a
+// transcript should have the same handlers as the room that recorded it.
+type ReplayConnection struct {
+	RealTime bool
+
+	mu       sync.Mutex
+	received []TranscriptEntry
+	next     int
+	sent     []*proto.Packet
+	done     chan struct{}
+}
+
+// ReadTranscript reads the entries of a transcript written by a
+// RecordingConnection.
+func ReadTranscript(rd io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("Error in transcript line %d: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// NewReplayConnection returns a Connection that replays the transcript read
+// from rd.
+func NewReplayConnection(rd io.Reader, realTime bool) (*ReplayConnection, error) {
+	entries, err := ReadTranscript(rd)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReplayConnection{RealTime: realTime, done: make(chan struct{})}
+	for _, entry := range entries {
+		if entry.Direction == TranscriptReceived && entry.Packet != nil {
+			rc.received = append(rc.received, entry)
+		}
+	}
+	if len(rc.received) == 0 {
+		close(rc.done)
+	}
+	return rc, nil
+}
+
+// ReplayFromFile returns a Connection that replays the transcript in the file
+// at path.
+func ReplayFromFile(path string, realTime bool) (*ReplayConnection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplayConnection(f, realTime)
+}
+
+// Done returns a channel that is closed once every received packet in the
+// transcript has been passed to the room.
+func (rc *ReplayConnection) Done() <-chan struct{} {
+	return rc.done
+}
+
+// Sent returns the packets the room has sent so far.
+func (rc *ReplayConnection) Sent() []*proto.Packet {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*proto.Packet(nil), rc.sent...)
+}
+
+// Connect is a no-op.
+func (rc *ReplayConnection) Connect(r *Room) error {
+	return nil
+}
+
+// SendJSON keeps the packet for Sent.
+func (rc *ReplayConnection) SendJSON(r *Room, msg interface{}) (string, error) {
+	p, ok := msg.(*proto.Packet)
+	if !ok {
+		return "", fmt.Errorf("Could not assert message as packet.")
+	}
+	rc.mu.Lock()
+	rc.sent = append(rc.sent, p)
+	rc.mu.Unlock()
+	return p.ID, nil
+}
+
+// ReceiveJSON passes the next received packet of the transcript to the room.
+// Once the transcript is exhausted it blocks until the room's context is
+// finished.
+func (rc *ReplayConnection) ReceiveJSON(r *Room, p chan *proto.Packet) {
+	rc.mu.Lock()
+	if rc.next >= len(rc.received) {
+		rc.mu.Unlock()
+		<-r.Ctx.Done()
+		return
+	}
+	entry := rc.received[rc.next]
+	var delay time.Duration
+	if rc.RealTime && rc.next > 0 {
+		delay = entry.Time.Sub(rc.received[rc.next-1].Time)
+	}
+	rc.next++
+	last := rc.next == len(rc.received)
+	rc.mu.Unlock()
+
+	if delay > 0 {
+		if err := sleepContext(r.Ctx, delay); err != nil {
+			return
+		}
+	}
+	packet := *entry.Packet
+	if r.Ctx.Alive() {
+		p <- &packet
+	}
+	if last {
+		close(rc.done)
+	}
+}
+
+// Close is a no-op.
+func (rc *ReplayConnection) Close() error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package gobot
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"euphoria.io/heim/proto"
+	. "gopkg.in/check.v1"
+)
+
+type TranscriptSuite struct{}
+
+var _ = Suite(&TranscriptSuite{})
+
+func (s *TranscriptSuite) TestRecordAndReplay(c *C) {
+	b, conn, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	room, _ := b.Room("test")
+	var transcript bytes.Buffer
+	room.conn = NewRecordingConnection(conn, &transcript)
+	room.Handlers = []Handler{&PongHandler{}}
+	go room.Run()
+
+	ping, _ := MakePacket(proto.PingEventType, proto.PingEvent{})
+	conn.incoming <- ping
+	c.Check((<-conn.outgoing).Type, Equals, proto.PingReplyType)
+	conn.incoming <- sendEvent("!ping")
+	c.Check((<-conn.outgoing).Type, Equals, proto.SendType)
+	b.Stop()
+
+	entries, err := ReadTranscript(bytes.NewReader(transcript.Bytes()))
+	c.Assert(err, IsNil)
+	var got []string
+	for _, entry := range entries {
+		c.Check(entry.Time.IsZero(), Equals, false)
+		got = append(got, entry.Direction+" "+string(entry.Packet.Type))
+	}
+	c.Check(got, DeepEquals, []string{
+		"received ping-event",
+		"sent ping-reply",
+		"received send-event",
+		"sent send",
+	})
+
+	replay, err := NewReplayConnection(bytes.NewReader(transcript.Bytes()), false)
+	c.Assert(err, IsNil)
+	b, _, err = BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	room, _ = b.Room("test")
+	room.conn = replay
+	room.Handlers = []Handler{&PongHandler{}}
+	go room.Run()
+	select {
+	case <-replay.Done():
+	case <-time.After(time.Second):
+		c.Fatal("transcript was not replayed")
+	}
+	waitFor(c, func() bool { return len(replay.Sent()) == 2 })
+	sent := replay.Sent()
+	c.Check(sent[0].Type, Equals, proto.PingReplyType)
+	c.Check(sent[1].Type, Equals, proto.SendType)
+}
+
+func (s *TranscriptSuite) TestReplayRealTime(c *C) {
+	start := time.Now()
+	var transcript bytes.Buffer
+	enc := json.NewEncoder(&transcript)
+	for i, content := range []string{"one", "two"} {
+		enc.Encode(&TranscriptEntry{
+			Time:      start.Add(time.Duration(i) * 100 * time.Millisecond),
+			Direction: TranscriptReceived,
+			Packet:    sendEvent(content),
+		})
+	}
+
+	b, _, err := BasicMockBot()
+	c.Assert(err, IsNil)
+	defer b.Stop()
+	replay, err := NewReplayConnection(&transcript, true)
+	c.Assert(err, IsNil)
+	room, _ := b.Room("test")
+	room.conn = replay
+	h := newEventHandler()
+	room.Handlers = []Handler{h}
+	go room.Run()
+	expectEvent(c, h.events, "send one")
+	begin := time.Now()
+	expectEvent(c, h.events, "send two")
+	c.Check(time.Since(begin) >= 80*time.Millisecond, Equals, true)
+}